@@ -2,6 +2,8 @@ package agi
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -55,19 +57,104 @@ const (
 type AGI struct {
 	// Variables stored the initial variables
 	// transmitted from Asterisk at the start
-	// of the AGI session.
+	// of the AGI session.  It must be treated
+	// as read-only; use Variable to read it
+	// concurrently with SetVariableCache.
 	Variables map[string]string
+	varMu     sync.RWMutex
 
-	r    io.Reader
-	eagi io.Reader
-	w    io.Writer
+	r  io.Reader
+	br *bufio.Reader
+	w  io.Writer
+
+	// pending is a line already read from br, which readLine returns first
+	pending string
+
+	// streams are the auxiliary audio streams, the first one being EAGI
+	streams []io.Reader
 
 	conn net.Conn
 
 	mu sync.Mutex
 
+	// readMu serializes the reads of responses
+	readMu sync.Mutex
+
 	// Logging ability
 	logger *log.Logger
+
+	// sessionID identifies the session in logs
+	sessionID string
+
+	// language is applied to the channel before the first Say* command
+	language    string
+	languageSet bool
+
+	// debounce is the window within which a repeated digit is discarded
+	debounce time.Duration
+
+	// digitFeedback is the tone played after each digit gathered
+	digitFeedback string
+
+	timeouts Timeouts
+
+	// autoResync resynchronizes the protocol when a response cannot be parsed
+	autoResync bool
+
+	// clock is the time source for timeouts
+	clock Clock
+
+	// localVerbose receives a copy of the Verbose messages, if set
+	localVerbose io.Writer
+
+	// sampleRate converts playback offsets between durations and samples
+	sampleRate int
+
+	// redialer re-establishes the connection when a write fails
+	redialer Redialer
+
+	// echoSuppression discards a received line echoing the command sent
+	echoSuppression bool
+
+	// commandFilter validates or rewrites each command line before it is sent
+	commandFilter CommandFilter
+
+	// legacyResponses accepts replies lacking the `result=` prefix
+	legacyResponses bool
+
+	// collector accumulates command errors, if enabled
+	collector *ErrorCollector
+
+	// lineTerminator ends each command line sent
+	lineTerminator string
+
+	// sipHeaderPrefixes are the prefixes of the variables holding SIP headers
+	sipHeaderPrefixes []string
+
+	// unquoteValues strips the quotes around fully quoted values
+	unquoteValues bool
+
+	// autoAnswer answers the channel before the first audio command
+	autoAnswer bool
+	answered   bool
+
+	// onHold records whether the channel was placed on hold by Hold
+	onHold bool
+
+	// stateMu guards answered, languageSet and onHold, which background
+	// work such as the LimitCall warning may access
+	stateMu sync.Mutex
+
+	// hungup records whether Asterisk signalled the hangup of the channel
+	hungup         bool
+	hangupHandlers []func()
+	hangupMu       sync.Mutex
+
+	// done is closed when the channel hangs up or the session is closed
+	done chan struct{}
+
+	// sounds caches the files downloaded by StreamURL
+	sounds soundCache
 }
 
 // Response represents a response to an AGI
@@ -78,6 +165,9 @@ type Response struct {
 	Result       int    // Result is the numerical return (if parseable)
 	ResultString string // Result value as a string
 	Value        string // Value is the (optional) string value returned
+	Usage        string // Usage is the proper usage returned with a 520 status
+
+	raw string // raw is everything following the result, unmodified
 }
 
 // Res returns the ResultString of a Response, as well as any error encountered.  Depending on the command, this is sometimes more useful than Val()
@@ -95,12 +185,122 @@ func (r *Response) Val() (string, error) {
 	return r.Value, r.Error
 }
 
+// Fields parses the `key=value` pairs following the result, such as the
+// `endpos=1234` of STREAM FILE or the `score0=750 text0="hello"` of SPEECH
+// RECOGNIZE.  Double quoted values may contain spaces; the quotes are removed.
+// Tokens which are not pairs, such as `(timeout)`, are ignored.
+func (r *Response) Fields() map[string]string {
+	fields := make(map[string]string)
+	for _, token := range splitFields(r.raw) {
+		kv := strings.SplitN(token, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		fields[kv[0]] = unquote(kv[1])
+	}
+	return fields
+}
+
+// EndPos returns the `endpos` sample offset reported by commands which play
+// or record audio.  Digit grouping separators (`1,234`, `1.234`, `1 234`)
+// which some locales introduce are ignored.
+func (r *Response) EndPos() (int, error) {
+	if r.Error != nil {
+		return 0, r.Error
+	}
+	pieces := endposRegex.FindStringSubmatch(r.raw)
+	if pieces == nil {
+		return 0, errors.New("no endpos in response")
+	}
+	n, err := strconv.Atoi(strings.Map(func(c rune) rune {
+		if c < '0' || c > '9' {
+			return -1
+		}
+		return c
+	}, pieces[1]))
+	if err != nil {
+		return 0, errors.New("failed to parse endpos: " + err.Error())
+	}
+	return n, nil
+}
+
+// Data decodes the response to GET DATA: the digits received and whether
+// the input ended because the timeout expired (the `(timeout)` flag)
+// rather than on the `#` terminator or the maximum number of digits.
+func (r *Response) Data() (digits string, timeout bool) {
+	if r.Error != nil || r.Result < 0 {
+		return "", false
+	}
+	return r.ResultString, r.flag() == "timeout"
+}
+
+// flag returns the parenthesized flag, such as "timeout", which leads the
+// data following the result of some commands.
+func (r *Response) flag() string {
+	if !strings.HasPrefix(r.raw, "(") {
+		return ""
+	}
+	end := strings.Index(r.raw, ")")
+	if end < 0 {
+		return ""
+	}
+	return r.raw[1:end]
+}
+
+// Digit decodes the Result of a command which reports a DTMF digit as its
+// ASCII code (WAIT FOR DIGIT, STREAM FILE, SAY *, ...).  A result of 0 means
+// no digit was received and yields an empty string; a negative result means
+// the channel hung up or the command failed and yields ErrHangup.
+func (r *Response) Digit() (string, error) {
+	if r.Error != nil {
+		return "", r.Error
+	}
+	if r.Result < 0 {
+		return "", ErrHangup
+	}
+	if r.Result == 0 || !strconv.IsPrint(rune(r.Result)) {
+		return "", nil
+	}
+	return string(rune(r.Result)), nil
+}
+
 // Regex for AGI response result code and value
-var responseRegex = regexp.MustCompile(`^([\d]{3})\sresult=(\-?[[:alnum:]]*)(\s.*)?$`)
+var responseRegex = regexp.MustCompile(`^([\d]{3})\sresult=(\-?[[:alnum:]*#]*)(\s.*)?$`)
+
+// Regex for the start of a response line, found by Resync
+var resyncRegex = regexp.MustCompile(`^\d{3} result=`)
+
+// errParseResult is returned for a response which could not be parsed
+var errParseResult = errors.New("failed to parse result")
+
+// Regex for the endpos of a response, allowing for digit grouping
+var endposRegex = regexp.MustCompile(`endpos=\s*(\d+(?:[.,'_ \x{a0}\x{202f}]\d{3})*)`)
+
+// Regex for the numeric-only replies of some older Asterisk releases, such
+// as "200 1" or "200"
+var legacyResponseRegex = regexp.MustCompile(`^([\d]{3})(?:\s+(\-?[\d]+))?(\s.*)?$`)
 
 // ErrHangup indicates the channel hung up during processing
 var ErrHangup = errors.New("hangup")
 
+// ErrInvalidDTMF indicates a set of escape digits contains a character which is not a DTMF digit
+var ErrInvalidDTMF = errors.New("invalid DTMF digit")
+
+// ErrLineBreak indicates a command argument contains a line break, which could inject another command
+var ErrLineBreak = errors.New("line break in command argument")
+
+// ErrWriteTimeout indicates a command could not be sent within its timeout
+var ErrWriteTimeout = errors.New("write timeout")
+
+// ErrReadTimeout indicates the response to a command was not received within its timeout
+var ErrReadTimeout = errors.New("read timeout")
+
+// ErrSetFailed indicates Asterisk could not set a variable
+var ErrSetFailed = errors.New("set failed")
+
+// ErrNotSet indicates the requested variable is not set on the channel
+var ErrNotSet = errors.New("variable not set")
+
 const (
 	// StatusOK indicates the AGI command was
 	// accepted.
@@ -114,7 +314,8 @@ const (
 	// cannot be performed on a dead (hungup) channel.
 	StatusDeadChannel = 511
 
-	// StatusEndUsage indicates...TODO
+	// StatusEndUsage indicates the command syntax
+	// was invalid; the proper usage is returned.
 	StatusEndUsage = 520
 )
 
@@ -122,55 +323,118 @@ const (
 type HandlerFunc func(*AGI)
 
 // New creates an AGI session from the given reader and writer.
-func New(r io.Reader, w io.Writer) *AGI {
-	return NewWithEAGI(r, w, nil)
+func New(r io.Reader, w io.Writer, opts ...Option) *AGI {
+	return NewWithEAGI(r, w, nil, opts...)
 }
 
 // NewWithEAGI returns a new AGI session to the given `os.Stdin` `io.Reader`,
 // EAGI `io.Reader`, and `os.Stdout` `io.Writer`. The initial variables will
 // be read in.
-func NewWithEAGI(r io.Reader, w io.Writer, eagi io.Reader) *AGI {
+func NewWithEAGI(r io.Reader, w io.Writer, eagi io.Reader, opts ...Option) *AGI {
+	return newAGI(r, w, []io.Reader{eagi}, opts)
+}
+
+// NewWithStreams returns a new AGI session to the given reader and writer,
+// with any number of auxiliary audio streams, available through Stream.
+// The first auxiliary stream is the EAGI stream.
+func NewWithStreams(r io.Reader, w io.Writer, aux []io.Reader, opts ...Option) *AGI {
+	return newAGI(r, w, aux, opts)
+}
+
+// newAGI creates the AGI session and reads in the initial variables
+func newAGI(r io.Reader, w io.Writer, streams []io.Reader, opts []Option) *AGI {
 	a := AGI{
 		Variables: make(map[string]string),
 		r:         r,
+		br:        bufio.NewReader(r),
 		w:         w,
-		eagi:      eagi,
+		streams:   streams,
+		timeouts:  DefaultTimeouts,
+		clock:     realClock{},
+
+		lineTerminator: "\n",
+		sampleRate:     DefaultSampleRate,
 	}
 
-	s := bufio.NewScanner(a.r)
-	for s.Scan() {
-		if s.Text() == "" {
+	a.readVariables()
+
+	for _, opt := range opts {
+		opt(&a)
+	}
+
+	return &a
+}
+
+// readVariables reads the initial variables block, which ends with an empty
+// line, and derives the session ID from it
+func (a *AGI) readVariables() {
+	for {
+		line, err := a.readLine()
+		if line == "" {
 			break
 		}
 
-		terms := strings.SplitN(s.Text(), ":", 2)
+		terms := strings.SplitN(line, ":", 2)
 		if len(terms) == 2 {
 			a.Variables[strings.TrimSpace(terms[0])] = strings.TrimSpace(terms[1])
 		}
+		if err != nil {
+			break
+		}
 	}
 
-	return &a
+	a.sessionID = a.Variables["agi_uniqueid"]
+	if a.sessionID == "" {
+		a.sessionID = randomID()
+	}
+}
+
+// Reset reuses the AGI instance for a new session on the given reader and
+// writer: the variables and collected errors of the previous session are
+// discarded and the initial variables of the new one are read in.  If r is a
+// net.Conn, Close closes it from then on.  The options the instance was
+// created with are kept.
+func (a *AGI) Reset(r io.Reader, w io.Writer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.varMu.Lock()
+	defer a.varMu.Unlock()
+
+	a.r, a.br, a.w = r, bufio.NewReader(r), w
+	a.conn, _ = r.(net.Conn)
+	if a.collector != nil {
+		a.collector = &ErrorCollector{}
+	}
+	a.pending = ""
+	a.Variables = make(map[string]string)
+	a.stateMu.Lock()
+	a.languageSet, a.answered, a.onHold = false, false, false
+	a.stateMu.Unlock()
+	a.resetHangup()
+	a.removeSounds()
+	a.readVariables()
 }
 
 // NewConn returns a new AGI session bound to the given net.Conn interface
-func NewConn(conn net.Conn) *AGI {
-	a := New(conn, conn)
+func NewConn(conn net.Conn, opts ...Option) *AGI {
+	a := New(conn, conn, opts...)
 	a.conn = conn
 	return a
 }
 
 // NewStdio returns a new AGI session to stdin and stdout.
-func NewStdio() *AGI {
-	return New(os.Stdin, os.Stdout)
+func NewStdio(opts ...Option) *AGI {
+	return New(os.Stdin, os.Stdout, opts...)
 }
 
 // NewEAGI returns a new AGI session to stdin, the EAGI stream (FD=3), and stdout.
-func NewEAGI() *AGI {
-	return NewWithEAGI(os.Stdin, os.Stdout, os.NewFile(uintptr(3), "/dev/stdeagi"))
+func NewEAGI(opts ...Option) *AGI {
+	return NewWithEAGI(os.Stdin, os.Stdout, os.NewFile(uintptr(3), "/dev/stdeagi"), opts...)
 }
 
 // Listen binds an AGI HandlerFunc to the given TCP `host:port` address, creating a FastAGI service.
-func Listen(addr string, handler HandlerFunc) error {
+// The given options are applied to every accepted session.
+func Listen(addr string, handler HandlerFunc, opts ...Option) error {
 	if addr == "" {
 		addr = "localhost:4573"
 	}
@@ -187,12 +451,31 @@ func Listen(addr string, handler HandlerFunc) error {
 			return errors.New("failed to accept TCP connection: " + err.Error())
 		}
 
-		go handler(NewConn(conn))
+		go handler(NewConn(conn, opts...))
 	}
 }
 
+// redial replaces the connection with a new one from the Redialer and
+// writes the command line to it
+func (a *AGI) redial(cmdString string) error {
+	conn, err := a.redialer()
+	if err != nil {
+		return errors.New("failed to redial: " + err.Error())
+	}
+	if a.conn != nil {
+		a.conn.Close() // nolint: errcheck
+	}
+	a.conn, a.r, a.br, a.w = conn, conn, bufio.NewReader(conn), conn
+	a.pending = ""
+
+	_, err = a.w.Write([]byte(cmdString + a.lineTerminator))
+	return err
+}
+
 // Close closes any network connection associated with the AGI instance
 func (a *AGI) Close() (err error) {
+	a.closeDone()
+	a.removeSounds()
 	if a.conn != nil {
 		err = a.conn.Close()
 		a.conn = nil
@@ -200,19 +483,78 @@ func (a *AGI) Close() (err error) {
 	return
 }
 
+// Variable returns the given initial variable, or a value cached with
+// SetVariableCache, and whether it is present.  It is safe for concurrent use.
+func (a *AGI) Variable(key string) (string, bool) {
+	a.varMu.RLock()
+	defer a.varMu.RUnlock()
+	v, ok := a.Variables[key]
+	return v, ok
+}
+
+// SetVariableCache stores a value in the local variable cache, returned by
+// subsequent calls to Variable.  It does not change the channel variable.
+func (a *AGI) SetVariableCache(key, val string) {
+	a.varMu.Lock()
+	defer a.varMu.Unlock()
+	a.Variables[key] = val
+}
+
+// Snapshot returns a copy of the variables, which the caller may keep and
+// read while the session goes on.  It is safe for concurrent use.
+func (a *AGI) Snapshot() map[string]string {
+	a.varMu.RLock()
+	defer a.varMu.RUnlock()
+	vars := make(map[string]string, len(a.Variables))
+	for k, v := range a.Variables {
+		vars[k] = v
+	}
+	return vars
+}
+
+// SessionID returns the identifier of the session, used to correlate log
+// lines.  It is the `agi_uniqueid` of the channel when Asterisk sent one,
+// otherwise a random identifier generated when the session was created.
+func (a *AGI) SessionID() string {
+	return a.sessionID
+}
+
 // EAGI enables access to the EAGI incoming stream (if available).
 func (a *AGI) EAGI() io.Reader {
-	return a.eagi
+	return a.Stream(0)
+}
+
+// Stream returns the i-th auxiliary audio stream, or nil if there is none.
+func (a *AGI) Stream(i int) io.Reader {
+	if i < 0 || i >= len(a.streams) {
+		return nil
+	}
+	return a.streams[i]
 }
 
 // Command sends the given command line to stdout
 // and returns the response.
 // TODO: this does not handle multi-line responses properly
 func (a *AGI) Command(timeout time.Duration, cmd ...string) (resp *Response) {
+	return a.send(timeout, strings.Join(cmd, " "))
+}
+
+// Raw sends the given line verbatim, without any joining or quoting of
+// arguments, and returns the parsed response.  It is an escape hatch for
+// custom AGI commands loaded into Asterisk; the line must not contain the
+// terminating newline.
+func (a *AGI) Raw(line string, timeout time.Duration) *Response {
+	return a.send(timeout, line)
+}
+
+// send writes a command line and waits for its response
+func (a *AGI) send(timeout time.Duration, cmdString string) (resp *Response) {
 	resp = &Response{}
-	cmdString := strings.Join(cmd, " ")
 	var raw string
 
+	// hangup handlers may send commands, so they run once unlocked
+	defer a.runHangupHandlers()
+
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
@@ -233,98 +575,398 @@ func (a *AGI) Command(timeout time.Duration, cmd ...string) (resp *Response) {
 				resString += " Err:" + resp.Error.Error()
 			}
 			resString = "{" + strings.TrimSpace(resString) + "}"
-			a.logger.Printf("#%s -> %s -> %s", cmdString, raw, resString)
+			a.logger.Printf("[%s] #%s -> %s -> %s", a.sessionID, cmdString, raw, resString)
 		}()
 	}
 
-	_, err := a.w.Write([]byte(cmdString + "\n"))
-	if err != nil {
-		resp.Error = errors.New("failed to send command: " + err.Error())
+	if a.collector != nil {
+		defer func() {
+			a.collector.add(cmdString, resp.Error)
+		}()
+	}
+
+	var err error
+	if cmdString, err = a.write(timeout, cmdString); err != nil {
+		resp.Error = err
 		return
 	}
 
-	waitC := make(chan string, 1)
-	go func() {
-		defer func() {
-			waitC <- "ok"
-		}()
+	resp, raw = a.receive(timeout, cmdString)
 
-		s := bufio.NewScanner(a.r)
-		for s.Scan() {
-			raw = s.Text()
-			if raw == "" {
-				break
-			}
+	// garbage preceding the response: skip to the response, and parse it
+	if a.autoResync && errors.Is(resp.Error, errParseResult) {
+		if line, err := a.resync(timeout); err == nil && line != "" {
+			a.readMu.Lock()
+			a.pending = line
+			a.readMu.Unlock()
+			resp, raw = a.receive(timeout, cmdString)
+		}
+	}
+	return
+}
 
-			// ignore hangup signal, we dont handle it here
-			if strings.HasPrefix(raw, "HANGUP") {
-				continue
-			}
+// CommandNoWait sends the given command line without waiting for its
+// response, for fire-and-forget commands such as VERBOSE in a tight loop.
+// Asterisk still responds to the command: the response must be consumed
+// with Drain before any other command is sent, or it would be taken as the
+// response to that command.
+func (a *AGI) CommandNoWait(cmd ...string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-			// Parse and store the result code
-			pieces := responseRegex.FindStringSubmatch(raw)
-			if pieces == nil {
-				resp.Error = fmt.Errorf("failed to parse result: %s", raw)
-				break
-			}
+	_, err := a.write(0, strings.Join(cmd, " "))
+	return err
+}
 
-			// Status code is the first substring
-			resp.Status, err = strconv.Atoi(pieces[1])
-			if err != nil {
-				resp.Error = errors.New("failed to get status code: " + err.Error())
-				break
-			}
+// Drain waits for and returns the pending response to a command sent with
+// CommandNoWait.
+func (a *AGI) Drain(timeout time.Duration) *Response {
+	defer a.runHangupHandlers()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-			// Result code is the second substring
-			resp.ResultString = pieces[2]
-			resp.Result, err = strconv.Atoi(pieces[2])
-			if err != nil {
-				resp.Error = errors.New("failed to parse result-code as an integer: " + err.Error())
+	resp, _ := a.receive(timeout, "")
+	return resp
+}
+
+// Resync restores the protocol to a known state after a response could not
+// be parsed, e.g. because the connection delivered garbage or a partial
+// line: it discards what was received up to the next response line
+// (`200 result=...`) or blank line, included, waiting at most timeout.
+func (a *AGI) Resync(timeout time.Duration) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, err := a.resync(timeout)
+	return err
+}
+
+// resync reads up to the next response line or blank line, and returns it
+func (a *AGI) resync(timeout time.Duration) (string, error) {
+	type reply struct {
+		line string
+		err  error
+	}
+
+	waitC := make(chan reply, 1)
+	go func() {
+		a.readMu.Lock()
+		defer a.readMu.Unlock()
+
+		for {
+			line, err := a.readLine()
+			if resyncRegex.MatchString(line) {
+				waitC <- reply{line, nil}
+				return
+			}
+			if line == "" || err != nil {
+				waitC <- reply{"", err}
+				return
 			}
+		}
+	}()
 
-			// Value is the third (and optional) substring
-			wrappedVal := strings.TrimSpace(pieces[3])
-			resp.Value = strings.TrimSuffix(strings.TrimPrefix(wrappedVal, "("), ")")
+	var r reply
+	if timeout > 0 {
+		select {
+		case r = <-waitC:
+		case <-a.clock.After(timeout):
+			return "", ErrReadTimeout
+		}
+	} else {
+		r = <-waitC
+	}
+	return r.line, r.err
+}
 
-			// FIXME: handle multiple line return values
-			break // nolint
+// write sends a command line, returning it as actually sent.  The timeout
+// applies only if the writer supports write deadlines, as a net.Conn does.
+func (a *AGI) write(timeout time.Duration, cmdString string) (string, error) {
+	if a.commandFilter != nil {
+		filtered, err := a.commandFilter(cmdString)
+		if err != nil {
+			return cmdString, errors.New("command rejected: " + err.Error())
 		}
+		cmdString = filtered
+	}
+
+	// a line break would let an argument inject another command
+	if strings.ContainsAny(cmdString, "\r\n") {
+		return cmdString, ErrLineBreak
+	}
+
+	if d, ok := a.w.(interface{ SetWriteDeadline(time.Time) error }); ok && timeout > 0 {
+		d.SetWriteDeadline(time.Now().Add(timeout)) // nolint: errcheck
+		defer d.SetWriteDeadline(time.Time{})       // nolint: errcheck
+	}
+
+	_, err := a.w.Write([]byte(cmdString + a.lineTerminator))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return cmdString, ErrWriteTimeout
+	}
+	if err != nil && a.redialer != nil {
+		err = a.redial(cmdString)
+	}
+	if err != nil {
+		return cmdString, errors.New("failed to send command: " + err.Error())
+	}
+	return cmdString, nil
+}
+
+// receive waits for the response to the command line last sent, returning
+// it along with the raw response line
+func (a *AGI) receive(timeout time.Duration, cmdString string) (*Response, string) {
+	type reply struct {
+		resp *Response
+		raw  string
+	}
+
+	waitC := make(chan reply, 1)
+	go func() {
+		// A reader abandoned after a timeout keeps the read lock until the
+		// late response arrives, so that it is not taken for the response
+		// to the next command.
+		a.readMu.Lock()
+		defer a.readMu.Unlock()
+
+		resp, raw := a.readResponse(cmdString)
+		waitC <- reply{resp, raw}
 	}()
 
+	var r reply
 	if timeout > 0 {
 		select {
-		case <-waitC:
-		case <-time.After(timeout):
-			resp.Error = fmt.Errorf("timeout")
-			return
+		case r = <-waitC:
+		case <-a.clock.After(timeout):
+			return &Response{Error: ErrReadTimeout}, ""
 		}
 	} else {
-		<-waitC
+		r = <-waitC
 	}
 
 	// If the Status code is not 200, return an error
-	if resp.Status != 200 {
-		resp.Error = fmt.Errorf("Non-200 status code")
+	if r.resp.Error == nil && r.resp.Status != 200 {
+		r.resp.Error = fmt.Errorf("Non-200 status code")
+	}
+	return r.resp, r.raw
+}
+
+// readLine reads a line sent by Asterisk, without its terminator, which may
+// be either "\n" or "\r\n"
+func (a *AGI) readLine() (string, error) {
+	if line := a.pending; line != "" {
+		a.pending = ""
+		return line, nil
+	}
+	line, err := a.br.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// readUsage reads the lines of a 520 usage block, up to the
+// `520 End of proper usage.` terminator
+func (a *AGI) readUsage() string {
+	var lines []string
+	for {
+		line, err := a.readLine()
+		if strings.HasPrefix(line, "520 End") {
+			break
+		}
+		lines = append(lines, line)
+		if err != nil {
+			break
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// readResponse reads and parses a response line
+func (a *AGI) readResponse(cmdString string) (resp *Response, raw string) {
+	resp = &Response{}
+	for {
+		var rerr error
+		raw, rerr = a.readLine()
+		if raw == "" {
+			break
+		}
+
+		// the hangup signal precedes the response
+		if strings.HasPrefix(raw, "HANGUP") && rerr == nil {
+			a.markHangup()
+			continue
+		}
+
+		// some gateways echo the command back before responding
+		if a.echoSuppression && raw == cmdString && rerr == nil {
+			continue
+		}
+
+		// Invalid syntax, possibly followed by the proper usage
+		if strings.HasPrefix(raw, "520") {
+			resp.Status = StatusEndUsage
+			if strings.HasPrefix(raw, "520-") && rerr == nil {
+				resp.Usage = a.readUsage()
+			}
+			break
+		}
+
+		// commands are refused once the channel is dead, without a result
+		if strings.HasPrefix(raw, "511") {
+			resp.Status = StatusDeadChannel
+			resp.Error = ErrHangup
+			a.markHangup()
+			break
+		}
+
+		// Parse and store the result code
+		pieces := responseRegex.FindStringSubmatch(raw)
+		if pieces == nil && a.legacyResponses {
+			// legacy replies may omit the result, which then defaults to 0
+			if pieces = legacyResponseRegex.FindStringSubmatch(raw); pieces != nil && pieces[2] == "" {
+				pieces[2] = "0"
+			}
+		}
+		if pieces == nil {
+			resp.Error = fmt.Errorf("%w: %s", errParseResult, raw)
+			break
+		}
+
+		// Status code is the first substring
+		var err error
+		resp.Status, err = strconv.Atoi(pieces[1])
+		if err != nil {
+			resp.Error = errors.New("failed to get status code: " + err.Error())
+			break
+		}
+
+		// Result code is the second substring
+		resp.ResultString = pieces[2]
+		resp.Result, err = strconv.Atoi(pieces[2])
+		// GET DATA results are digit strings, possibly empty or with * and #
+		if err != nil && validateDTMFSet(pieces[2]) != nil {
+			resp.Error = errors.New("failed to parse result-code as an integer: " + err.Error())
+		}
+
+		// Value is the third (and optional) substring
+		wrappedVal := strings.TrimSpace(pieces[3])
+		resp.raw = wrappedVal
+		resp.Value = strings.TrimSuffix(strings.TrimPrefix(wrappedVal, "("), ")")
+		if a.unquoteValues {
+			resp.Value = unquote(resp.Value)
+		}
+
+		// FIXME: handle multiple line return values
+		break // nolint
 	}
 	return
 }
 
 // Answer answers the channel
 func (a *AGI) Answer() error {
-	return a.Command(30*time.Second, "ANSWER").Err()
+	resp := a.Command(a.timeouts.Answer, "ANSWER")
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if resp.Result < 0 {
+		return errors.New("failed to answer")
+	}
+	a.setAnswered()
+	return nil
+}
+
+// AnswerIfNeeded answers the channel unless it is already up
+func (a *AGI) AnswerIfNeeded() error {
+	state, err := a.Status()
+	if err != nil {
+		return err
+	}
+	if state == StateUp {
+		a.setAnswered()
+		return nil
+	}
+	return a.Answer()
+}
+
+// AnswerAfter lets the channel ring for the given delay before answering it,
+// which gives some phones time to display the caller ID.  It returns
+// ErrHangup if the caller hangs up while ringing.
+func (a *AGI) AnswerAfter(delay time.Duration) error {
+	deadline := a.clock.Now().Add(delay)
+	for remaining := delay; remaining > 0; remaining = deadline.Sub(a.clock.Now()) {
+		// digits received while ringing are discarded
+		if _, err := a.WaitForDigit(remaining); err != nil {
+			return err
+		}
+	}
+	return a.Answer()
+}
+
+// AnswerWithRetry answers the channel, trying up to attempts times, with the
+// given delay in between, for trunks on which answering right after the
+// ring may fail transiently.  It stops early with ErrHangup if the channel
+// hangs up, and returns the last error once the attempts are exhausted.
+func (a *AGI) AnswerWithRetry(attempts int, delay time.Duration) (err error) {
+	for i := 0; i < attempts; i++ {
+		if i > 0 && delay > 0 {
+			<-a.clock.After(delay)
+		}
+		if err = a.Answer(); err == nil {
+			return nil
+		}
+		if a.isHungup() {
+			return ErrHangup
+		}
+	}
+	if err == nil {
+		err = errors.New("no answer attempt")
+	}
+	return err
 }
 
 // Status returns the channel status
 func (a *AGI) Status() (State, error) {
-	r, err := a.Command(5*time.Second, "CHANNEL STATUS").Val()
-	if err != nil {
-		return StateDown, err
+	// the state is the result; there is no value
+	resp := a.Command(a.timeouts.Status, "CHANNEL STATUS")
+	if resp.Error != nil {
+		return StateDown, resp.Error
 	}
-	state, err := strconv.Atoi(r)
-	if err != nil {
-		return StateDown, fmt.Errorf("Failed to parse state %s", r)
+	if resp.Result < 0 {
+		return StateDown, fmt.Errorf("Failed to parse state %s", resp.ResultString)
+	}
+	return State(resp.Result), nil
+}
+
+// statePollInterval is the interval at which WaitForAnyState polls the channel status
+const statePollInterval = 500 * time.Millisecond
+
+// WaitForState waits until the channel reaches the given state, or the
+// context is done.
+func (a *AGI) WaitForState(ctx context.Context, target State) error {
+	_, err := a.WaitForAnyState(ctx, target)
+	return err
+}
+
+// WaitForAnyState waits until the channel reaches one of the given states,
+// polling its status, and returns the state reached.  It returns the
+// context error if the context is done first.
+func (a *AGI) WaitForAnyState(ctx context.Context, targets ...State) (State, error) {
+	for {
+		state, err := a.Status()
+		if err != nil {
+			return state, err
+		}
+		for _, t := range targets {
+			if state == t {
+				return state, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return state, ctx.Err()
+		case <-a.clock.After(statePollInterval):
+		}
 	}
-	return State(state), nil
 }
 
 // Exec runs a dialplan application
@@ -335,21 +977,108 @@ func (a *AGI) Exec(timeout time.Duration, cmd ...string) (string, error) {
 
 // Get gets the value of the given channel variable
 func (a *AGI) Get(key string) (string, error) {
-	return a.Command(5*time.Second, "GET VARIABLE", key).Val()
+	return a.Command(a.timeouts.Variable, "GET VARIABLE", key).Val()
+}
+
+// GetFull evaluates the given expression on the channel, expanding any
+// variables and dialplan functions it contains (e.g. `${CALLERID(num)}`).
+func (a *AGI) GetFull(expr string) (string, error) {
+	return a.Command(a.timeouts.Variable, "GET FULL VARIABLE", quoteArg(expr)).Val()
 }
 
-// GetData plays a file and receives DTMF, returning the received digits
+// GetData plays a file and receives DTMF, returning the received digits.  A
+// maxdigits of zero or less leaves the number of digits unlimited (up to the
+// Asterisk limit of 1024): input then ends with `#` or the timeout.
 func (a *AGI) GetData(sound string, timeout time.Duration, maxdigits int) (digits string, err error) {
 	if sound == "" {
 		sound = "silence/1"
 	}
-	resp := a.Command(0, "GET DATA", sound, toMSec(timeout), strconv.Itoa(maxdigits))
+	if err := a.ensureAnswered(); err != nil {
+		return "", err
+	}
+	cmd := []string{"GET DATA", sound, toMSec(timeout)}
+	// Asterisk takes an explicit 0 literally, returning no digits at all
+	if maxdigits > 0 {
+		cmd = append(cmd, strconv.Itoa(maxdigits))
+	}
+	resp := a.Command(0, cmd...)
+	if resp.Error == nil && resp.Result < 0 {
+		return "", ErrHangup
+	}
 	return resp.Res()
 }
 
+// backgroundExten is the extension BackgroundGet sets before running
+// Background, which no digit string can equal
+const backgroundExten = "agi-background"
+
+// BackgroundGet plays a file with the dialplan Background application and
+// keeps collecting DTMF once it stops, like `Background` followed by
+// `WaitExten` would, returning up to maxDigits digits (unlimited if
+// maxDigits <= 0).  Each further digit is awaited at most timeout, and `#`
+// ends the collection.  Run from AGI, Background returns the first digit
+// pressed as its result; should it store the digit in the channel extension
+// instead, as it does from the dialplan, the digit is read from there.  The
+// extension and priority are restored before returning.
+func (a *AGI) BackgroundGet(sound string, maxDigits int, timeout time.Duration) (digits string, err error) {
+	exten, _ := a.Variable("agi_extension")
+	priority, _ := a.Variable("agi_priority")
+
+	if err := a.Command(a.timeouts.Variable, "SET EXTENSION", backgroundExten).Err(); err != nil {
+		return "", err
+	}
+	defer func() {
+		if rerr := a.restoreLocation(exten, priority); rerr != nil && err == nil {
+			err = rerr
+		}
+	}()
+
+	resp := a.Command(0, "EXEC", "Background", sound)
+	if resp.Error != nil {
+		return "", resp.Error
+	}
+	if resp.Result < 0 {
+		return "", ErrHangup
+	}
+
+	// res_agi disables the dialplan workarounds around EXEC, so the digit
+	// is the result rather than the extension
+	if resp.Result > 0 {
+		digits = string(rune(resp.Result))
+	} else {
+		if digits, err = a.Get("EXTEN"); err != nil {
+			return "", err
+		}
+		if digits == backgroundExten {
+			digits = ""
+		}
+	}
+	if digits == "#" {
+		return "", nil
+	}
+
+	if maxDigits > 0 && len(digits) >= maxDigits {
+		return digits[:maxDigits], nil
+	}
+	rest, err := a.WaitForDigits(timeout, maxDigits-len(digits), "#")
+	return digits + rest, err
+}
+
+// restoreLocation sets the dialplan extension and priority back, so that the
+// dialplan resumes where it ran the AGI script
+func (a *AGI) restoreLocation(exten, priority string) error {
+	if err := a.Command(a.timeouts.Variable, "SET EXTENSION", exten).Err(); err != nil {
+		return err
+	}
+	if priority == "" {
+		return nil
+	}
+	return a.Command(a.timeouts.Variable, "SET PRIORITY", priority).Err()
+}
+
 // Hangup terminates the call
 func (a *AGI) Hangup() error {
-	return a.Command(1*time.Second, "HANGUP").Err()
+	return a.Command(a.timeouts.Hangup, "HANGUP").Err()
 }
 
 // RecordOptions describes the options available when recording
@@ -375,6 +1104,18 @@ type RecordOptions struct {
 
 // Record records audio to a file
 func (a *AGI) Record(name string, opts *RecordOptions) error {
+	resp := a.record(name, opts)
+	if resp.Error == nil && resp.Result < 0 {
+		if resp.flag() == "writefile" {
+			return ErrRecordWrite
+		}
+		return ErrHangup
+	}
+	return resp.Err()
+}
+
+// record sends the RECORD FILE command described by opts, filling in its defaults
+func (a *AGI) record(name string, opts *RecordOptions) *Response {
 	if opts == nil {
 		opts = &RecordOptions{}
 	}
@@ -387,6 +1128,16 @@ func (a *AGI) Record(name string, opts *RecordOptions) error {
 	if opts.Timeout == 0 {
 		opts.Timeout = 5 * time.Minute
 	}
+	if err := validateDTMFSet(opts.EscapeDigits); err != nil {
+		return &Response{Error: err}
+	}
+	name, err := sanitizeFileName(name)
+	if err != nil {
+		return &Response{Error: err}
+	}
+	if err := a.ensureAnswered(); err != nil {
+		return &Response{Error: err}
+	}
 
 	cmd := strings.Join([]string{
 		"RECORD FILE ",
@@ -408,34 +1159,55 @@ func (a *AGI) Record(name string, opts *RecordOptions) error {
 		cmd += " s=" + toSec(opts.Silence)
 	}
 
-	return a.Command(0, cmd).Err()
+	return a.Command(0, cmd)
 }
 
 // SayAlpha plays a character string, annunciating each character.
 func (a *AGI) SayAlpha(label string, escapeDigits string) (digit string, err error) {
+	if err := validateDTMFSet(escapeDigits); err != nil {
+		return "", err
+	}
+
 	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
 	if escapeDigits == "" {
 		escapeDigits = `""`
 	}
-	return a.Command(0, "SAY ALPHA", label, escapeDigits).Val()
+	if err := a.beforeSay(); err != nil {
+		return "", err
+	}
+	return a.Command(0, "SAY ALPHA", label, escapeDigits).Digit()
 }
 
 // SayDigits plays a digit string, annunciating each digit.
 func (a *AGI) SayDigits(number string, escapeDigits string) (digit string, err error) {
+	if err := validateDTMFSet(escapeDigits); err != nil {
+		return "", err
+	}
+
 	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
 	if escapeDigits == "" {
 		escapeDigits = `""`
 	}
-	return a.Command(0, "SAY DIGITS", number, escapeDigits).Val()
+	if err := a.beforeSay(); err != nil {
+		return "", err
+	}
+	return a.Command(0, "SAY DIGITS", number, escapeDigits).Digit()
 }
 
 // SayDate plays a date
 func (a *AGI) SayDate(when time.Time, escapeDigits string) (digit string, err error) {
+	if err := validateDTMFSet(escapeDigits); err != nil {
+		return "", err
+	}
+
 	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
 	if escapeDigits == "" {
 		escapeDigits = `""`
 	}
-	return a.Command(0, "SAY DATE", toEpoch(when), escapeDigits).Val()
+	if err := a.beforeSay(); err != nil {
+		return "", err
+	}
+	return a.Command(0, "SAY DATE", toEpoch(when), escapeDigits).Digit()
 }
 
 // SayDateTime plays a date using the given format.  See `voicemail.conf` for the format syntax; defaults to `ABdY 'digits/at' IMp`.
@@ -443,6 +1215,10 @@ func (a *AGI) SayDateTime(when time.Time, escapeDigits string, format string) (d
 	// Extract the timezone from the time
 	zone, _ := when.Zone()
 
+	if err := validateDTMFSet(escapeDigits); err != nil {
+		return "", err
+	}
+
 	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
 	if escapeDigits == "" {
 		escapeDigits = `""`
@@ -453,53 +1229,142 @@ func (a *AGI) SayDateTime(when time.Time, escapeDigits string, format string) (d
 		format = "ABdY 'digits/at' IMp"
 	}
 
-	return a.Command(0, "SAY DATETIME", toEpoch(when), escapeDigits, format, zone).Val()
+	if err := a.beforeSay(); err != nil {
+		return "", err
+	}
+	args := sayDateTimeArgs(toEpoch(when), escapeDigits, format, zone)
+	return a.Command(0, append([]string{"SAY DATETIME"}, args...)...).Digit()
 }
 
 // SayNumber plays the given number.
 func (a *AGI) SayNumber(number string, escapeDigits string) (digit string, err error) {
+	if err := validateDTMFSet(escapeDigits); err != nil {
+		return "", err
+	}
+
 	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
 	if escapeDigits == "" {
 		escapeDigits = `""`
 	}
-	return a.Command(0, "SAY NUMBER", number, escapeDigits).Val()
+	if err := a.beforeSay(); err != nil {
+		return "", err
+	}
+	return a.Command(0, "SAY NUMBER", number, escapeDigits).Digit()
 }
 
 // SayPhonetic plays the given phrase phonetically
 func (a *AGI) SayPhonetic(phrase string, escapeDigits string) (digit string, err error) {
+	if err := validateDTMFSet(escapeDigits); err != nil {
+		return "", err
+	}
+
 	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
 	if escapeDigits == "" {
 		escapeDigits = `""`
 	}
-	return a.Command(0, "SAY PHOENTIC", phrase, escapeDigits).Val()
+	if err := a.beforeSay(); err != nil {
+		return "", err
+	}
+	return a.Command(0, "SAY PHOENTIC", phrase, escapeDigits).Digit()
 }
 
 // SayTime plays the time part of the given timestamp
 func (a *AGI) SayTime(when time.Time, escapeDigits string) (digit string, err error) {
+	if err := validateDTMFSet(escapeDigits); err != nil {
+		return "", err
+	}
+
 	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
 	if escapeDigits == "" {
 		escapeDigits = `""`
 	}
-	return a.Command(0, "SAY TIME", toEpoch(when), escapeDigits).Val()
+	if err := a.beforeSay(); err != nil {
+		return "", err
+	}
+	return a.Command(0, "SAY TIME", toEpoch(when), escapeDigits).Digit()
 }
 
 // Set sets the given channel variable to
 // the provided value.
 func (a *AGI) Set(key, val string) error {
-	return a.Command(5*time.Second, "SET VARIABLE", key, val).Err()
+	// Asterisk reports a failure with a 200 status and a result of 0
+	resp := a.Command(a.timeouts.Variable, "SET VARIABLE", key, val)
+	switch {
+	case resp.Error != nil:
+		return resp.Error
+	case resp.Result < 0:
+		return ErrHangup
+	case resp.Result == 0:
+		return ErrSetFailed
+	}
+	return nil
+}
+
+// SetJSON stores the JSON encoding of v in the given channel variable, where
+// the dialplan (or a later AGI) may read it back with GetJSON.
+func (a *AGI) SetJSON(key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.New("failed to encode value: " + err.Error())
+	}
+	return a.Set(key, quoteArg(string(b)))
+}
+
+// GetJSON decodes the JSON stored in the given channel variable into v.  It
+// returns ErrNotSet if the variable does not exist.
+func (a *AGI) GetJSON(key string, v interface{}) error {
+	resp := a.Command(a.timeouts.Variable, "GET VARIABLE", key)
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if resp.Result == 0 {
+		return ErrNotSet
+	}
+	if err := json.Unmarshal([]byte(resp.Value), v); err != nil {
+		return errors.New("failed to decode value: " + err.Error())
+	}
+	return nil
 }
 
 // StreamFile plays the given file to the channel
 func (a *AGI) StreamFile(name string, escapeDigits string, offset int) (digit string, err error) {
+	return a.streamFile(name, escapeDigits, offset).Digit()
+}
+
+// streamFile plays the given file, returning the response with the end position
+func (a *AGI) streamFile(name string, escapeDigits string, offset int) *Response {
+	return a.streamFileWithin(a.timeouts.StreamFile, name, escapeDigits, offset)
+}
+
+// streamFileWithin plays the given file, waiting at most timeout for the
+// playback to end
+func (a *AGI) streamFileWithin(timeout time.Duration, name string, escapeDigits string, offset int) *Response {
+	if err := validateDTMFSet(escapeDigits); err != nil {
+		return &Response{Error: err}
+	}
+	name, err := sanitizeFileName(name)
+	if err != nil {
+		return &Response{Error: err}
+	}
+
 	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
 	if escapeDigits == "" {
 		escapeDigits = `""`
 	}
-	return a.Command(60*time.Second, "STREAM FILE", name, escapeDigits, strconv.Itoa(offset)).Val()
+	if err := a.ensureAnswered(); err != nil {
+		return &Response{Error: err}
+	}
+	return a.Command(timeout, "STREAM FILE", name, escapeDigits, strconv.Itoa(offset))
 }
 
 // Verbose logs the given message to the verbose message system
 func (a *AGI) Verbose(msg string, level int) error {
+	if strings.ContainsAny(msg, "\r\n") {
+		return ErrLineBreak
+	}
+	if a.localVerbose != nil {
+		fmt.Fprintf(a.localVerbose, "[%s] %s\n", a.sessionID, msg) // nolint: errcheck
+	}
 	return a.Command(0, "VERBOSE", strconv.Quote(msg), strconv.Itoa(level)).Err()
 }
 
@@ -510,12 +1375,52 @@ func (a *AGI) Verbosef(format string, args ...interface{}) error {
 
 // WaitForDigit waits for a DTMF digit and returns what is received
 func (a *AGI) WaitForDigit(timeout time.Duration) (digit string, err error) {
-	resp := a.Command(0, "WAIT FOR DIGIT", toMSec(timeout))
-	resp.ResultString = ""
-	if resp.Error == nil && strconv.IsPrint(rune(resp.Result)) {
-		resp.ResultString = string(resp.Result)
+	return a.Command(0, "WAIT FOR DIGIT", toMSec(timeout)).Digit()
+}
+
+// WaitForDigits collects up to maxDigits DTMF digits (unlimited if maxDigits <= 0), waiting at most timeout for each one.  Collection stops early when no digit arrives in time or when one of the terminators is received; the terminator is not part of the returned digits.  When the session was created WithDebounce, a digit identical to the previous one and received within the debounce window is discarded.
+func (a *AGI) WaitForDigits(timeout time.Duration, maxDigits int, terminators string) (digits string, err error) {
+	var last string
+	var lastAt time.Time
+	var feedback bool
+	defer func() {
+		if !feedback {
+			return
+		}
+		if serr := a.execApp("StopPlaytones", ""); serr != nil && err == nil {
+			err = serr
+		}
+	}()
+
+	for maxDigits <= 0 || len(digits) < maxDigits {
+		digit, err := a.WaitForDigit(timeout)
+		if err != nil {
+			return digits, err
+		}
+		if digit == "" {
+			break
+		}
+
+		now := a.clock.Now()
+		if a.debounce > 0 && digit == last && now.Sub(lastAt) < a.debounce {
+			lastAt = now
+			continue
+		}
+		last, lastAt = digit, now
+
+		if strings.Contains(terminators, digit) {
+			break
+		}
+		digits += digit
+
+		if a.digitFeedback != "" {
+			if err := a.PlayTone(a.digitFeedback, 0); err != nil {
+				return digits, err
+			}
+			feedback = true
+		}
 	}
-	return resp.Res()
+	return digits, nil
 }
 
 // SetLogger setup external logger for low-level logging
@@ -527,8 +1432,8 @@ func (a *AGI) SetLogger(l *log.Logger) error {
 
 	// Output variables
 	if a.logger != nil {
-		for k, v := range a.Variables {
-			a.logger.Printf("$%s=%s\n", k, v)
+		for k, v := range a.Snapshot() {
+			a.logger.Printf("[%s] $%s=%s\n", a.sessionID, k, v)
 		}
 	}
 
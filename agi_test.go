@@ -0,0 +1,1015 @@
+package agi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAutoResync(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		result int
+		err    bool
+	}{
+		{name: "clean", script: "200 result=1\n200 result=7\n", result: 1},
+		{name: "garbage", script: "noise\n200 result=1\n200 result=7\n", result: 1},
+		{name: "garbage lines", script: "noise\nmore noise\r\n200 result=2 (x)\n200 result=7\n", result: 2},
+		{name: "no response", script: "noise\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out, WithAutoResync())
+
+			resp := a.Command(0, "ANSWER")
+			if tt.err {
+				if resp.Error == nil {
+					t.Errorf("no error for %+v", resp)
+				}
+				return
+			}
+			if resp.Error != nil || resp.Result != tt.result {
+				t.Fatalf("got %+v, want result %d", resp, tt.result)
+			}
+			// the stream stays in step for the next command
+			if resp := a.Command(0, "NOOP"); resp.Error != nil || resp.Result != 7 {
+				t.Errorf("next command got %+v", resp)
+			}
+			if want := "ANSWER\nNOOP\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestResync(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{name: "stale response", script: "ult=1\n200 result=1 (stale)\n200 result=5\n"},
+		{name: "blank line", script: "partial line\n\n200 result=5\n"},
+		{name: "crlf", script: "garbage\r\n200 result=0\r\n200 result=5\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &bytes.Buffer{})
+			if err := a.Resync(time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if resp := a.Command(0, "NOOP"); resp.Error != nil || resp.Result != 5 {
+				t.Errorf("got %+v after resync, want result 5", resp)
+			}
+		})
+	}
+
+	r, closer := silentReader("agi_uniqueid: 1\n\n")
+	defer closer.Close() // nolint: errcheck
+	clock := &fakeClock{}
+	a := New(r, &bytes.Buffer{}, WithClock(clock))
+	errC := make(chan error, 1)
+	go func() { errC <- a.Resync(time.Second) }()
+	waitTimer(t, clock)
+	clock.Advance(time.Second)
+	if err := <-errC; !errors.Is(err, ErrReadTimeout) {
+		t.Errorf("got %v, want ErrReadTimeout", err)
+	}
+}
+
+func TestDigit(t *testing.T) {
+	tests := []struct {
+		response string
+		digit    string
+		err      error
+	}{
+		{response: "200 result=0", digit: ""},
+		{response: "200 result=49", digit: "1"},
+		{response: "200 result=35", digit: "#"},
+		{response: "200 result=42 endpos=1200", digit: "*"},
+		{response: "200 result=-1", err: ErrHangup},
+		{response: "200 result=-1 endpos=0", err: ErrHangup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.response, func(t *testing.T) {
+			for name, run := range map[string]func(a *AGI) (string, error){
+				"WaitForDigit": func(a *AGI) (string, error) { return a.WaitForDigit(time.Second) },
+				"StreamFile":   func(a *AGI) (string, error) { return a.StreamFile("hello", "", 0) },
+				"SayNumber":    func(a *AGI) (string, error) { return a.SayNumber("5", "") },
+			} {
+				a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &bytes.Buffer{})
+				digit, err := run(a)
+				if digit != tt.digit || !errors.Is(err, tt.err) {
+					t.Errorf("%s: got %q, %v; want %q, %v", name, digit, err, tt.digit, tt.err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetData(t *testing.T) {
+	tests := []struct {
+		maxdigits int
+		response  string
+		sent      string
+		want      string
+	}{
+		{maxdigits: 4, response: "200 result=1234", sent: "GET DATA hello 5000 4\n", want: "1234"},
+		{maxdigits: 0, response: "200 result=123456789", sent: "GET DATA hello 5000\n", want: "123456789"},
+		{maxdigits: -1, response: "200 result=12 (timeout)", sent: "GET DATA hello 5000\n", want: "12"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &out)
+		got, err := a.GetData("hello", 5*time.Second, tt.maxdigits)
+		if err != nil || got != tt.want {
+			t.Errorf("%d: got %q, %v; want %q", tt.maxdigits, got, err, tt.want)
+		}
+		if out.String() != tt.sent {
+			t.Errorf("%d: sent %q, want %q", tt.maxdigits, out.String(), tt.sent)
+		}
+	}
+}
+
+func TestHangupResult(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(a *AGI) error
+	}{
+		{"GetData", func(a *AGI) error { _, err := a.GetData("hello", time.Second, 4); return err }},
+		{"Record", func(a *AGI) error { return a.Record("msg", nil) }},
+	}
+	for _, tt := range tests {
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=-1\n"), &bytes.Buffer{})
+		if err := tt.run(a); !errors.Is(err, ErrHangup) {
+			t.Errorf("%s: got %v, want ErrHangup", tt.name, err)
+		}
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	tests := []struct {
+		name      string
+		handshake string
+		want      string
+	}{
+		{name: "uniqueid", handshake: "agi_uniqueid: 1700000000.42\n\n", want: "1700000000.42"},
+		{name: "random", handshake: "agi_channel: SIP/1\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(strings.NewReader(tt.handshake+"200 result=1\n"), &bytes.Buffer{})
+			id := a.SessionID()
+			if tt.want != "" && id != tt.want {
+				t.Errorf("got %q, want %q", id, tt.want)
+			}
+			if id == "" {
+				t.Fatal("empty session ID")
+			}
+
+			var logs bytes.Buffer
+			if err := a.SetLogger(log.New(&logs, "", 0)); err != nil {
+				t.Fatal(err)
+			}
+			a.Answer() // nolint: errcheck
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				if !strings.HasPrefix(line, "["+id+"] ") {
+					t.Errorf("log line without the session ID: %q", line)
+				}
+			}
+		})
+	}
+}
+
+// fakeClock is a Clock whose time advances by step at each reading of Now,
+// and by Advance, which fires the timers due
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	step   time.Duration
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now
+	c.now = c.now.Add(c.step)
+	return now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := fakeTimer{c.now.Add(d), make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	return t.c
+}
+
+// Advance moves the clock forward by d
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+// pending returns the number of timers not fired yet
+func (c *fakeClock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// digitResponses returns the WAIT FOR DIGIT responses to the given digits
+func digitResponses(digits string) string {
+	var b strings.Builder
+	for _, d := range digits {
+		fmt.Fprintf(&b, "200 result=%d\n", d)
+	}
+	return b.String()
+}
+
+func TestWaitForDigits(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        []Option
+		script      string
+		max         int
+		terminators string
+		want        string
+		err         error
+	}{
+		{name: "max digits", script: digitResponses("1234"), max: 3, want: "123"},
+		{name: "unlimited", script: digitResponses("1234") + "200 result=0\n", want: "1234"},
+		{name: "timeout", script: digitResponses("12") + "200 result=0\n", max: 4, want: "12"},
+		{name: "terminator", script: digitResponses("12#3"), max: 4, terminators: "#", want: "12"},
+		{name: "hangup", script: digitResponses("1") + "200 result=-1\n", max: 4, want: "1", err: ErrHangup},
+		{
+			name:   "debounced",
+			opts:   []Option{WithDebounce(150 * time.Millisecond), WithClock(&fakeClock{step: 100 * time.Millisecond})},
+			script: digitResponses("11223"),
+			max:    3, want: "123",
+		},
+		{
+			name:   "repeated slowly",
+			opts:   []Option{WithDebounce(150 * time.Millisecond), WithClock(&fakeClock{step: 200 * time.Millisecond})},
+			script: digitResponses("112"),
+			max:    3, want: "112",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &bytes.Buffer{}, tt.opts...)
+			got, err := a.WaitForDigits(time.Second, tt.max, tt.terminators)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("got %q, %v; want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		err      error
+	}{
+		{name: "set", response: "200 result=1"},
+		{name: "failed", response: "200 result=0", err: ErrSetFailed},
+		{name: "hangup", response: "200 result=-1", err: ErrHangup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &out)
+			if err := a.Set("FOO", "bar"); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			if want := "SET VARIABLE FOO bar\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestJSON(t *testing.T) {
+	type order struct {
+		ID    int      `json:"id"`
+		Items []string `json:"items"`
+	}
+
+	var out bytes.Buffer
+	a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=1\n"), &out)
+	if err := a.SetJSON("ORDER", order{7, []string{"a b", `"c"`}}); err != nil {
+		t.Fatal(err)
+	}
+	if want := `SET VARIABLE ORDER "{\"id\":7,\"items\":[\"a b\",\"\\\"c\\\"\"]}"` + "\n"; out.String() != want {
+		t.Errorf("sent %q, want %q", out.String(), want)
+	}
+
+	tests := []struct {
+		name     string
+		response string
+		want     order
+		err      error
+		invalid  bool
+	}{
+		{name: "set", response: `200 result=1 ({"id":7,"items":["a (b)"]})`, want: order{7, []string{"a (b)"}}},
+		{name: "not set", response: "200 result=0", err: ErrNotSet},
+		{name: "not JSON", response: "200 result=1 (seven)", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &bytes.Buffer{})
+			var got order
+			err := a.GetJSON("ORDER", &got)
+			if tt.invalid {
+				if err == nil {
+					t.Error("no error for invalid JSON")
+				}
+				return
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnswerAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		sent   string
+		err    bool
+	}{
+		{
+			name:   "answered",
+			script: "200 result=0\n200 result=0\n200 result=0\n200 result=0\n",
+			sent:   "WAIT FOR DIGIT 3000\nWAIT FOR DIGIT 2000\nWAIT FOR DIGIT 1000\nANSWER\n",
+		},
+		{
+			name:   "digit discarded",
+			script: "200 result=49\n200 result=0\n200 result=0\n200 result=0\n",
+			sent:   "WAIT FOR DIGIT 3000\nWAIT FOR DIGIT 2000\nWAIT FOR DIGIT 1000\nANSWER\n",
+		},
+		{
+			name:   "hangup while ringing",
+			script: "200 result=0\nHANGUP\n200 result=-1\n",
+			sent:   "WAIT FOR DIGIT 3000\nWAIT FOR DIGIT 2000\n",
+			err:    true,
+		},
+		{
+			name:   "dead channel",
+			script: "511 Command Not Permitted on a dead channel\n",
+			sent:   "WAIT FOR DIGIT 3000\n",
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out, WithClock(&fakeClock{step: time.Second}))
+			err := a.AnswerAfter(3 * time.Second)
+			if tt.err != (err != nil) {
+				t.Errorf("got error %v", err)
+			}
+			if tt.err && a.Alive() {
+				t.Error("channel still alive after the hangup")
+			}
+			if out.String() != tt.sent {
+				t.Errorf("sent %q, want %q", out.String(), tt.sent)
+			}
+		})
+	}
+}
+
+func TestAnswerWithRetry(t *testing.T) {
+	const dead = "511 Command Not Permitted on a dead channel or intercept routine\n"
+	tests := []struct {
+		name     string
+		attempts int
+		script   string
+		answers  int
+		err      error
+	}{
+		{name: "first", attempts: 3, script: "200 result=0\n", answers: 1},
+		{name: "second", attempts: 3, script: "200 result=-1\n200 result=0\n", answers: 2},
+		{name: "exhausted", attempts: 2, script: "200 result=-1\n200 result=-1\n", answers: 2, err: errors.New("failed to answer")},
+		{name: "hangup", attempts: 3, script: "200 result=-1\n" + dead, answers: 2, err: ErrHangup},
+		{name: "no attempt", err: errors.New("no answer attempt")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			clock := &fakeClock{}
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out, WithClock(clock))
+			stop := ticking(clock, time.Second)
+			defer stop()
+
+			if err := a.AnswerWithRetry(tt.attempts, time.Second); fmt.Sprint(err) != fmt.Sprint(tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			if want := strings.Repeat("ANSWER\n", tt.answers); out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestResponseFields(t *testing.T) {
+	tests := []struct {
+		response string
+		want     map[string]string
+	}{
+		{"200 result=0", map[string]string{}},
+		{"200 result=0 endpos=1234", map[string]string{"endpos": "1234"}},
+		{"200 result=1 (timeout) endpos=80", map[string]string{"endpos": "80"}},
+		{
+			`200 result=1 (speech) endpos=0 results=1 score0=750 text0="hello world" grammar0=yesno`,
+			map[string]string{"endpos": "0", "results": "1", "score0": "750", "text0": "hello world", "grammar0": "yesno"},
+		},
+	}
+	for _, tt := range tests {
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &bytes.Buffer{})
+		got := a.Command(0, "NOOP").Fields()
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.response, got, tt.want)
+		}
+	}
+}
+
+func TestRaw(t *testing.T) {
+	tests := []struct {
+		line     string
+		response string
+		result   int
+		value    string
+		err      error
+	}{
+		{line: "MY CUSTOM COMMAND  a  \"b c\"", response: "200 result=1 (done)", result: 1, value: "done"},
+		{line: "NOOP", response: "200 result=0", result: 0},
+		{line: "NOOP\nHANGUP", err: ErrLineBreak},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &out)
+		resp := a.Raw(tt.line, time.Second)
+		if !errors.Is(resp.Error, tt.err) {
+			t.Errorf("%q: got error %v, want %v", tt.line, resp.Error, tt.err)
+			continue
+		}
+		if tt.err != nil {
+			if out.Len() != 0 {
+				t.Errorf("%q: sent %q", tt.line, out.String())
+			}
+			continue
+		}
+		if resp.Result != tt.result || resp.Value != tt.value {
+			t.Errorf("%q: got %+v", tt.line, resp)
+		}
+		if out.String() != tt.line+"\n" {
+			t.Errorf("sent %q, want %q", out.String(), tt.line+"\n")
+		}
+	}
+}
+
+func TestVariableCache(t *testing.T) {
+	var out bytes.Buffer
+	a := New(strings.NewReader("agi_uniqueid: 1\nagi_callerid: 100\n\n"), &out)
+
+	tests := []struct {
+		key  string
+		want string
+		ok   bool
+	}{
+		{"agi_callerid", "100", true},
+		{"agi_dnid", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := a.Variable(tt.key); got != tt.want || ok != tt.ok {
+			t.Errorf("%s: got %q, %v; want %q, %v", tt.key, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// concurrent readers and writers, for the race detector
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			a.SetVariableCache("KEY", strconv.Itoa(i))
+		}(i)
+		go func() {
+			defer wg.Done()
+			a.Variable("KEY")
+		}()
+	}
+	wg.Wait()
+
+	if _, ok := a.Variable("KEY"); !ok {
+		t.Error("cached value missing")
+	}
+	if out.Len() != 0 {
+		t.Errorf("the cache sent %q", out.String())
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	a := New(strings.NewReader("agi_uniqueid: 1\nagi_callerid: 100\n\n"), &bytes.Buffer{})
+	snap := a.Snapshot()
+	if len(snap) != 2 || snap["agi_callerid"] != "100" {
+		t.Errorf("got %v", snap)
+	}
+
+	// the copy and the variables are independent
+	snap["agi_callerid"] = "200"
+	a.SetVariableCache("agi_dnid", "300")
+	if got, _ := a.Variable("agi_callerid"); got != "100" {
+		t.Errorf("changing the copy changed the variable to %q", got)
+	}
+	if _, ok := snap["agi_dnid"]; ok {
+		t.Error("the copy holds a later variable")
+	}
+
+	// logging the variables while the session sets some, for the race detector
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			a.SetVariableCache("KEY"+strconv.Itoa(i), "x")
+		}(i)
+		go func() {
+			defer wg.Done()
+			for k, v := range a.Snapshot() {
+				_ = k + v
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := len(a.Snapshot()); got != 7 {
+		t.Errorf("got %d variables, want 7", got)
+	}
+}
+
+func TestBackgroundGet(t *testing.T) {
+	const ok = "200 result=0\n"
+	tests := []struct {
+		name   string
+		script string
+		max    int
+		want   string
+		sent   []string
+		err    error
+	}{
+		{
+			name:   "digits during and after the prompt",
+			script: ok + "200 result=49\n" + digitResponses("23") + ok + ok,
+			max:    3, want: "123",
+			sent: []string{
+				"SET EXTENSION agi-background", "EXEC Background menu",
+				"WAIT FOR DIGIT 2000", "WAIT FOR DIGIT 2000", "SET EXTENSION s", "SET PRIORITY 3",
+			},
+		},
+		{
+			name:   "one digit",
+			script: ok + "200 result=55\n" + ok + ok,
+			max:    1, want: "7",
+			sent: []string{"SET EXTENSION agi-background", "EXEC Background menu", "SET EXTENSION s", "SET PRIORITY 3"},
+		},
+		{
+			name:   "no digit",
+			script: ok + ok + "200 result=1 (agi-background)\n" + ok + ok + ok,
+			max:    3, want: "",
+			sent: []string{
+				"SET EXTENSION agi-background", "EXEC Background menu", "GET VARIABLE EXTEN",
+				"WAIT FOR DIGIT 2000", "SET EXTENSION s", "SET PRIORITY 3",
+			},
+		},
+		{
+			// should Background store the digit in the extension instead
+			name:   "digit in the extension",
+			script: ok + ok + "200 result=1 (1)\n" + digitResponses("2") + ok + ok,
+			max:    2, want: "12",
+			sent: []string{
+				"SET EXTENSION agi-background", "EXEC Background menu", "GET VARIABLE EXTEN",
+				"WAIT FOR DIGIT 2000", "SET EXTENSION s", "SET PRIORITY 3",
+			},
+		},
+		{
+			name:   "terminated",
+			script: ok + "200 result=52\n" + digitResponses("#") + ok + ok,
+			want:   "4",
+			sent: []string{
+				"SET EXTENSION agi-background", "EXEC Background menu",
+				"WAIT FOR DIGIT 2000", "SET EXTENSION s", "SET PRIORITY 3",
+			},
+		},
+		{
+			name:   "terminated during the prompt",
+			script: ok + "200 result=35\n" + ok + ok,
+			max:    3,
+			sent:   []string{"SET EXTENSION agi-background", "EXEC Background menu", "SET EXTENSION s", "SET PRIORITY 3"},
+		},
+		{
+			name:   "hangup",
+			script: ok + "200 result=-1\n" + ok + ok,
+			max:    3,
+			sent:   []string{"SET EXTENSION agi-background", "EXEC Background menu", "SET EXTENSION s", "SET PRIORITY 3"},
+			err:    ErrHangup,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_extension: s\nagi_priority: 3\n\n"+tt.script), &out)
+			got, err := a.BackgroundGet("menu", tt.max, 2*time.Second)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("got %q, %v; want %q, %v", got, err, tt.want, tt.err)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestNewWithStreams(t *testing.T) {
+	eagi, aux := strings.NewReader("eagi"), strings.NewReader("aux")
+	var out bytes.Buffer
+	a := NewWithStreams(strings.NewReader("agi_uniqueid: 1\n\n200 result=0\n200 result=0\n200 result=0\n"), &out, []io.Reader{eagi, aux}, WithAutoAnswer())
+
+	tests := []struct {
+		i    int
+		want io.Reader
+	}{
+		{-1, nil},
+		{0, eagi},
+		{1, aux},
+		{2, nil},
+	}
+	for _, tt := range tests {
+		if got := a.Stream(tt.i); got != tt.want {
+			t.Errorf("Stream(%d) = %v, want %v", tt.i, got, tt.want)
+		}
+	}
+	if a.EAGI() != eagi {
+		t.Error("EAGI is not the first stream")
+	}
+	if New(strings.NewReader("\n"), &bytes.Buffer{}).EAGI() != nil {
+		t.Error("EAGI stream without any stream")
+	}
+
+	// the options are applied
+	if _, err := a.SayDigits("1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if want := "CHANNEL STATUS\nANSWER\nSAY DIGITS 1 \"\"\n"; out.String() != want {
+		t.Errorf("sent %q, want %q", out.String(), want)
+	}
+}
+
+func TestResponseData(t *testing.T) {
+	tests := []struct {
+		response string
+		digits   string
+		timeout  bool
+	}{
+		{"200 result=1234", "1234", false},
+		{"200 result=12 (timeout)", "12", true},
+		{"200 result= (timeout)", "", true},
+		{"200 result=*9#", "*9#", false},
+		{"200 result=-1", "", false},
+	}
+	for _, tt := range tests {
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &bytes.Buffer{})
+		digits, timeout := a.Command(0, "GET DATA", "beep", "5000").Data()
+		if digits != tt.digits || timeout != tt.timeout {
+			t.Errorf("%q: got %q, %v; want %q, %v", tt.response, digits, timeout, tt.digits, tt.timeout)
+		}
+	}
+}
+
+func TestLineBreak(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		run  func(a *AGI) error
+	}{
+		{name: "Get", run: func(a *AGI) error { _, err := a.Get("X\nHANGUP"); return err }},
+		{name: "Set", run: func(a *AGI) error { return a.Set("X", "1\r\nHANGUP") }},
+		{name: "Verbose", run: func(a *AGI) error { return a.Verbose("a\rb", 1) }},
+		{
+			name: "filtered",
+			opts: []Option{WithCommandFilter(func(line string) (string, error) { return line + "\nHANGUP", nil })},
+			run:  func(a *AGI) error { return a.Answer() },
+		},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=1\n"), &out, tt.opts...)
+		if err := tt.run(a); !errors.Is(err, ErrLineBreak) {
+			t.Errorf("%s: got %v, want ErrLineBreak", tt.name, err)
+		}
+		if out.Len() != 0 {
+			t.Errorf("%s: sent %q", tt.name, out.String())
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	var out bytes.Buffer
+	a := New(strings.NewReader("agi_uniqueid: 1\nagi_callerid: 100\n\n200 result=0\n200 result=0\n200 result=0\n"), &out, WithAutoAnswer())
+	a.SetVariableCache("CACHED", "x")
+	if _, err := a.SayDigits("1", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var next bytes.Buffer
+	a.Reset(strings.NewReader("agi_uniqueid: 2\nagi_dnid: 200\n\n200 result=0\n200 result=0\n200 result=0\n"), &next)
+
+	tests := []struct {
+		key  string
+		want string
+		ok   bool
+	}{
+		{"agi_uniqueid", "2", true},
+		{"agi_dnid", "200", true},
+		{"agi_callerid", "", false},
+		{"CACHED", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := a.Variable(tt.key); got != tt.want || ok != tt.ok {
+			t.Errorf("%s: got %q, %v; want %q, %v", tt.key, got, ok, tt.want, tt.ok)
+		}
+	}
+	if a.SessionID() != "2" {
+		t.Errorf("got session ID %q, want 2", a.SessionID())
+	}
+
+	// the options are kept, and the new channel answered again
+	if _, err := a.SayDigits("2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if want := "CHANNEL STATUS\nANSWER\nSAY DIGITS 2 \"\"\n"; next.String() != want {
+		t.Errorf("sent %q, want %q", next.String(), want)
+	}
+	if want := "CHANNEL STATUS\nANSWER\nSAY DIGITS 1 \"\"\n"; out.String() != want {
+		t.Errorf("sent %q to the previous session, want %q", out.String(), want)
+	}
+}
+
+func TestResetConn(t *testing.T) {
+	tests := []struct {
+		name   string
+		conn   bool
+		closed bool
+	}{
+		{name: "conn", conn: true, closed: true},
+		{name: "reader", conn: false, closed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := deadConn("agi_uniqueid: 1\n\n")
+			a := NewConn(first, WithErrorCollector())
+			if err := a.Answer(); err == nil {
+				t.Fatal("answered on a closed connection")
+			}
+
+			client, server := net.Pipe()
+			defer server.Close() // nolint: errcheck
+
+			go server.Write([]byte("agi_uniqueid: 2\n\n")) // nolint: errcheck
+			if tt.conn {
+				a.Reset(client, client)
+			} else {
+				a.Reset(bufio.NewReader(client), client)
+			}
+			if errs := a.Errors(); len(errs) != 0 {
+				t.Errorf("got errors %v from the previous session", errs)
+			}
+
+			if err := a.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := first.SetDeadline(time.Time{}); !errors.Is(err, io.ErrClosedPipe) {
+				t.Errorf("the previous connection is not closed: %v", err)
+			}
+			err := client.SetDeadline(time.Time{})
+			if closed := errors.Is(err, io.ErrClosedPipe); closed != tt.closed {
+				t.Errorf("got closed %v, want %v", closed, tt.closed)
+			}
+			client.Close() // nolint: errcheck
+		})
+	}
+}
+
+func TestCommandNoWait(t *testing.T) {
+	var out bytes.Buffer
+	script := "agi_uniqueid: 1\n\n200 result=1\n200 result=2\n200 result=3\n200 result=1 (up)\n"
+	a := New(strings.NewReader(script), &out)
+
+	for i := 0; i < 3; i++ {
+		if err := a.CommandNoWait("VERBOSE", strconv.Quote(strconv.Itoa(i)), "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		if resp := a.Drain(time.Second); resp.Error != nil || resp.Result != i {
+			t.Errorf("response %d: got %+v", i, resp)
+		}
+	}
+	if v, err := a.Get("STATE"); err != nil || v != "up" {
+		t.Errorf("got %q, %v after draining", v, err)
+	}
+	want := "VERBOSE \"0\" 1\nVERBOSE \"1\" 1\nVERBOSE \"2\" 1\nGET VARIABLE STATE\n"
+	if out.String() != want {
+		t.Errorf("sent %q, want %q", out.String(), want)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	r, closer := silentReader("agi_uniqueid: 1\n\n")
+	defer closer.Close() // nolint: errcheck
+	a := New(r, &bytes.Buffer{})
+	if resp := a.Drain(10 * time.Millisecond); !errors.Is(resp.Error, ErrReadTimeout) {
+		t.Errorf("got %v, want ErrReadTimeout", resp.Error)
+	}
+}
+
+func TestEndPos(t *testing.T) {
+	tests := []struct {
+		response string
+		want     int
+		err      bool
+	}{
+		{response: "200 result=0 endpos=1234", want: 1234},
+		{response: "200 result=0 endpos=1,234", want: 1234},
+		{response: "200 result=0 endpos=1.234.567", want: 1234567},
+		{response: "200 result=0 endpos=12 345", want: 12345},
+		{response: "200 result=49 endpos=0", want: 0},
+		{response: "200 result=0", err: true},
+	}
+	for _, tt := range tests {
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &bytes.Buffer{})
+		got, err := a.Command(0, "STREAM FILE", "a", `""`, "0").EndPos()
+		if got != tt.want || tt.err != (err != nil) {
+			t.Errorf("%q: got %d, %v; want %d", tt.response, got, err, tt.want)
+		}
+	}
+}
+
+// ticking advances clock by step every millisecond until the returned stop
+// function is called
+func ticking(clock *fakeClock, step time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				clock.Advance(step)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func TestWaitForAnyState(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		targets []State
+		want    State
+		polls   int
+		err     bool
+	}{
+		{name: "already up", script: "200 result=6\n", targets: []State{StateUp}, want: StateUp, polls: 1},
+		{name: "answered", script: "200 result=4\n200 result=4\n200 result=6\n", targets: []State{StateUp}, want: StateUp, polls: 3},
+		{name: "any", script: "200 result=4\n200 result=5\n", targets: []State{StateUp, StateRinging}, want: StateRinging, polls: 2},
+		{name: "dead", script: "200 result=4\n200 result=-1\n", targets: []State{StateUp}, polls: 2, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			clock := &fakeClock{}
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out, WithClock(clock))
+			stop := ticking(clock, statePollInterval)
+			defer stop()
+
+			state, err := a.WaitForAnyState(context.Background(), tt.targets...)
+			if tt.err != (err != nil) || !tt.err && state != tt.want {
+				t.Errorf("got %v, %v; want %v", state, err, tt.want)
+			}
+			if want := strings.Repeat("CHANNEL STATUS\n", tt.polls); out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestWaitForStateCanceled(t *testing.T) {
+	a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=4\n"), &bytes.Buffer{}, WithClock(&fakeClock{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.WaitForState(ctx, StateUp); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		usage  string
+	}{
+		{
+			name:   "block",
+			script: "520-Invalid command syntax.  Proper usage follows:\nUsage: WAIT FOR DIGIT <timeout>\n\n  Waits up to timeout milliseconds.\n520 End of proper usage.\n",
+			usage:  "Usage: WAIT FOR DIGIT <timeout>\n\n  Waits up to timeout milliseconds.",
+		},
+		{name: "single line", script: "520 Invalid command syntax.\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script+"200 result=49\n"), &bytes.Buffer{})
+			resp := a.Command(0, "WAIT FOR DIGIT")
+			if resp.Status != StatusEndUsage || resp.Error == nil {
+				t.Errorf("got %+v, want an error with status 520", resp)
+			}
+			if resp.Usage != tt.usage {
+				t.Errorf("got usage %q, want %q", resp.Usage, tt.usage)
+			}
+			// the next response is read in step
+			if digit, err := a.WaitForDigit(time.Second); digit != "1" || err != nil {
+				t.Errorf("next command got %q, %v", digit, err)
+			}
+		})
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	tests := []struct {
+		name  string
+		serve func(server net.Conn)
+		err   error
+	}{
+		{
+			name:  "write",
+			serve: func(net.Conn) {},
+			err:   ErrWriteTimeout,
+		},
+		{
+			name:  "read",
+			serve: func(server net.Conn) { bufio.NewReader(server).ReadString('\n') }, // nolint: errcheck
+			err:   ErrReadTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close() // nolint: errcheck
+			go func() {
+				server.Write([]byte("agi_uniqueid: 1\n\n")) // nolint: errcheck
+				tt.serve(server)
+			}()
+			a := NewConn(client)
+			defer a.Close() // nolint: errcheck
+
+			if resp := a.Command(20*time.Millisecond, "ANSWER"); !errors.Is(resp.Error, tt.err) {
+				t.Errorf("got %v, want %v", resp.Error, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,438 @@
+package agi
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Callback originates a call to tech/resource (e.g. "PJSIP", "alice") and,
+// once it is answered, bridges it with the current channel, making this
+// channel the B-leg.  It returns the `ORIGINATE_STATUS` (SUCCESS, FAILURE,
+// BUSY, CONGESTION, HANGUP, RINGING or UNKNOWN), with an error for any
+// status but SUCCESS.
+//
+// AGI is synchronous: the command blocks until the callee answers or the
+// timeout expires, and once bridged the current channel leaves the AGI
+// script for the duration of the bridge, so nothing else can be done with
+// this session meanwhile.
+func (a *AGI) Callback(tech, resource string, timeout time.Duration) (string, error) {
+	channel, _ := a.Variable("agi_channel")
+	args := a.appArgs(
+		tech+"/"+resource,
+		"app",
+		"Bridge",
+		channel,
+		"",
+		strconv.Itoa(int(timeout.Seconds())),
+	)
+
+	if _, err := a.Exec(0, "Originate", quoteArg(args)); err != nil {
+		return "", err
+	}
+
+	status, err := a.Get("ORIGINATE_STATUS")
+	if err != nil {
+		return "", err
+	}
+	if status != "SUCCESS" {
+		return status, fmt.Errorf("originate failed: %s", status)
+	}
+	return status, nil
+}
+
+// namedTones are the tones defined for every country in indications.conf
+var namedTones = map[string]bool{
+	"dial":        true,
+	"busy":        true,
+	"ring":        true,
+	"congestion":  true,
+	"callwaiting": true,
+	"dialrecall":  true,
+	"record":      true,
+	"info":        true,
+	"stutter":     true,
+}
+
+// Regex for a custom tone list, such as "440+480/2000,0/4000" or "!950/330"
+var toneRegex = regexp.MustCompile(`^!?\d+([+*]\d+)?(/\d+)?(,!?\d+([+*]\d+)?(/\d+)?)*$`)
+
+// PlayTone plays a tone, either one of the tones named in indications.conf
+// (dial, busy, ring, congestion, ...) or a custom tone list in the
+// indications.conf syntax, such as "440+480/2000,0/4000".  If duration is
+// positive, the tone is stopped after it elapses; otherwise the tone keeps
+// playing in the background until the next audio is played.
+func (a *AGI) PlayTone(tone string, duration time.Duration) error {
+	if !namedTones[tone] && !toneRegex.MatchString(tone) {
+		return fmt.Errorf("invalid tone %q", tone)
+	}
+
+	if err := a.execApp("Playtones", tone); err != nil {
+		return err
+	}
+	if duration <= 0 {
+		return nil
+	}
+
+	if err := a.execApp("Wait", strconv.FormatFloat(duration.Seconds(), 'f', -1, 64)); err != nil {
+		return err
+	}
+	return a.execApp("StopPlaytones", "")
+}
+
+// execApp runs the given dialplan application, returning ErrHangup if it
+// reports the channel hung up.
+func (a *AGI) execApp(app, args string) error {
+	cmd := []string{"EXEC", app}
+	if args != "" {
+		cmd = append(cmd, quoteArg(args))
+	}
+	resp := a.Command(0, cmd...)
+	if resp.Error == nil && resp.Result < 0 {
+		return ErrHangup
+	}
+	return resp.Err()
+}
+
+// muteDirections maps the directions accepted by Mute and Unmute to those of
+// the MUTEAUDIO dialplan function
+var muteDirections = map[string]string{
+	"in":   "in",
+	"out":  "out",
+	"both": "all",
+}
+
+// Mute drops the audio of the channel in the given direction: "in" (from the
+// caller, e.g. to keep a PIN out of a recording), "out" (to the caller) or
+// "both".
+func (a *AGI) Mute(direction string) error {
+	return a.setMute(direction, "on")
+}
+
+// Unmute restores the audio of the channel muted with Mute.
+func (a *AGI) Unmute(direction string) error {
+	return a.setMute(direction, "off")
+}
+
+func (a *AGI) setMute(direction, state string) error {
+	d, ok := muteDirections[direction]
+	if !ok {
+		return fmt.Errorf("invalid mute direction %q", direction)
+	}
+	return a.execSet("MUTEAUDIO("+d+")", state)
+}
+
+// SecureGetData collects digits like GetData, with the audio from the caller
+// muted meanwhile so that the tones of sensitive data such as a PIN or a
+// card number do not end up in an in-progress recording.  The audio is
+// unmuted before returning, even on error.  Muting relies on the digits
+// being sent out of band (RFC 2833 or SIP INFO), as in-band tones are muted
+// too.
+func (a *AGI) SecureGetData(sound string, maxDigits int, timeout time.Duration) (digits string, err error) {
+	if err = a.Mute("in"); err != nil {
+		return "", err
+	}
+	defer func() {
+		if uerr := a.Unmute("in"); uerr != nil && err == nil {
+			err = uerr
+		}
+	}()
+
+	return a.GetData(sound, timeout, maxDigits)
+}
+
+// Ringing indicates ringing to the caller before the channel is answered.
+func (a *AGI) Ringing() error {
+	return a.execApp("Ringing", "")
+}
+
+// Progress sends early media (call progress) to the caller before the
+// channel is answered, so that audio can be played without answering.
+func (a *AGI) Progress() error {
+	return a.execApp("Progress", "")
+}
+
+// audioCodecs are the audio codec names known to Asterisk
+var audioCodecs = map[string]bool{
+	"ulaw":     true,
+	"alaw":     true,
+	"gsm":      true,
+	"g722":     true,
+	"g723":     true,
+	"g726":     true,
+	"g726aal2": true,
+	"g729":     true,
+	"ilbc":     true,
+	"lpc10":    true,
+	"opus":     true,
+	"silk":     true,
+	"siren7":   true,
+	"siren14":  true,
+	"speex":    true,
+	"speex16":  true,
+	"speex32":  true,
+	"adpcm":    true,
+	"slin":     true,
+	"slin16":   true,
+	"testlaw":  true,
+}
+
+// SetCodecs restricts the audio codecs offered on the channel to the given
+// ones, in order of preference, through `PJSIP_MEDIA_OFFER(audio)`.  To
+// constrain the outbound leg of a Dial, set it from that leg's pre-dial
+// handler.
+func (a *AGI) SetCodecs(codecs []string) error {
+	if len(codecs) == 0 {
+		return errors.New("no codec given")
+	}
+	for _, c := range codecs {
+		if !audioCodecs[c] {
+			return fmt.Errorf("unknown codec %q", c)
+		}
+	}
+	return a.execSet("PJSIP_MEDIA_OFFER(audio)", strings.Join(codecs, ","))
+}
+
+// WaitForFax listens for the CNG tone of a calling fax machine for up to
+// timeout, using the WaitForCNG dialplan application, and reports whether
+// it was detected, so that fax calls may be routed away from voice prompts.
+func (a *AGI) WaitForFax(timeout time.Duration) (bool, error) {
+	secs := strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64)
+	if err := a.execApp("WaitForCNG", a.appArgs("1", secs)); err != nil {
+		return false, err
+	}
+
+	status, err := a.Get("WAITFORTONESTATUS")
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case "SUCCESS":
+		return true, nil
+	case "HANGUP":
+		return false, ErrHangup
+	case "ERROR":
+		return false, errors.New("fax detection failed")
+	}
+	return false, nil
+}
+
+// StartCallRecording records both sides of the call to the given file with
+// the MixMonitor dialplan application, in the background, until the call
+// ends or StopCallRecording is called.  The options are those of MixMonitor
+// (e.g. "b" to only record while bridged).
+func (a *AGI) StartCallRecording(filename, options string) error {
+	args := filename
+	if options != "" {
+		args = a.appArgs(filename, options)
+	}
+	return a.execApp("MixMonitor", args)
+}
+
+// StopCallRecording stops the recording started by StartCallRecording.
+func (a *AGI) StopCallRecording() error {
+	return a.execApp("StopMixMonitor", "")
+}
+
+// SetMusic starts or stops the music on hold of the given class ("default"
+// if empty) on the channel.
+func (a *AGI) SetMusic(on bool, class string) error {
+	if !on {
+		return a.Command(0, "SET MUSIC OFF").Err()
+	}
+	if class == "" {
+		class = "default"
+	}
+	return a.Command(0, "SET MUSIC ON", class).Err()
+}
+
+// WithMusic plays the music on hold of the given class while fn runs, such
+// as a slow lookup the caller must wait for, and returns the error of fn.
+// The music is stopped afterwards, even if fn fails.
+func (a *AGI) WithMusic(class string, fn func() error) (err error) {
+	if err = a.SetMusic(true, class); err != nil {
+		return err
+	}
+	defer func() {
+		if serr := a.SetMusic(false, ""); serr != nil && err == nil {
+			err = serr
+		}
+	}()
+
+	return fn()
+}
+
+// Hold places the channel on hold, playing it the default music on hold in
+// the background with the StartMusicOnHold dialplan application, until
+// Unhold is called.
+func (a *AGI) Hold() error {
+	if err := a.execApp("StartMusicOnHold", ""); err != nil {
+		return err
+	}
+	a.stateMu.Lock()
+	a.onHold = true
+	a.stateMu.Unlock()
+	return nil
+}
+
+// Unhold retrieves the channel placed on hold by Hold, with the
+// StopMusicOnHold dialplan application.
+func (a *AGI) Unhold() error {
+	if err := a.execApp("StopMusicOnHold", ""); err != nil {
+		return err
+	}
+	a.stateMu.Lock()
+	a.onHold = false
+	a.stateMu.Unlock()
+	return nil
+}
+
+// IsOnHold reports whether the channel was placed on hold by Hold and not
+// retrieved since.
+func (a *AGI) IsOnHold() bool {
+	a.stateMu.Lock()
+	defer a.stateMu.Unlock()
+	return a.onHold
+}
+
+// Park parks the call in the default parking lot with the Park dialplan
+// application, for at most timeout if positive (the lot's parkingtime
+// otherwise).  Park announces the parking slot to the caller, who can tell
+// whoever is to retrieve the call, then blocks while the call is parked: it
+// returns once the call has left the lot, either retrieved or timed out.  An
+// error is returned if the call could not be parked (no `PARKINGSLOT` was
+// assigned), and for a timeout before Asterisk 1.6, whose Park takes none.
+func (a *AGI) Park(timeout time.Duration) error {
+	args, err := a.dialect().parkArgs(timeout)
+	if err != nil {
+		return err
+	}
+	if err := a.execApp("Park", args); err != nil {
+		return err
+	}
+
+	slot, err := a.Get("PARKINGSLOT")
+	if err != nil {
+		return err
+	}
+	if slot == "" {
+		return errors.New("failed to park the call")
+	}
+	return nil
+}
+
+// BlindTransfer transfers the party bridged with the channel to exten in
+// context with the BlindTransfer dialplan application.  The channel must be
+// bridged, e.g. running the script from a features.conf applicationmap
+// feature: the channel of a plain AGI call is not, and ErrNotBridged is
+// returned for it.  An error is returned for any `BLINDTRANSFERSTATUS` but
+// SUCCESS.
+func (a *AGI) BlindTransfer(exten, context string) error {
+	if exten == "" || context == "" {
+		return errors.New("transfer needs an extension and a context")
+	}
+	if err := a.checkBridged(); err != nil {
+		return err
+	}
+	if err := a.execApp("BlindTransfer", a.appArgs(exten, context)); err != nil {
+		return err
+	}
+	status, err := a.Get("BLINDTRANSFERSTATUS")
+	if err == nil && status != "SUCCESS" {
+		err = fmt.Errorf("blind transfer failed: %s", status)
+	}
+	return err
+}
+
+// AttendedTransfer starts an attended transfer of the party bridged with the
+// channel to exten in context with the AttendedTransfer dialplan
+// application, which takes the context from `TRANSFER_CONTEXT`, set first.
+// As for BlindTransfer, the channel must be bridged.  It returns the
+// `ATTENDEDTRANSFERSTATUS` (SUCCESS, FAILURE, INVALID or NOTPERMITTED), with
+// an error for any status but SUCCESS.
+func (a *AGI) AttendedTransfer(exten, context string) (string, error) {
+	if exten == "" || context == "" {
+		return "", errors.New("transfer needs an extension and a context")
+	}
+	if err := a.checkBridged(); err != nil {
+		return "", err
+	}
+	if err := a.execSet("TRANSFER_CONTEXT", context); err != nil {
+		return "", err
+	}
+	if err := a.execApp("AttendedTransfer", exten); err != nil {
+		return "", err
+	}
+	status, err := a.Get("ATTENDEDTRANSFERSTATUS")
+	if err == nil && status != "SUCCESS" {
+		err = fmt.Errorf("attended transfer failed: %s", status)
+	}
+	return status, err
+}
+
+// ErrNotBridged indicates the channel is not bridged with another party, as
+// the transfer applications require
+var ErrNotBridged = errors.New("channel is not bridged")
+
+// checkBridged returns ErrNotBridged unless the channel has a bridge peer
+func (a *AGI) checkBridged() error {
+	peer, err := a.Get("BRIDGEPEER")
+	if err != nil {
+		return err
+	}
+	if peer == "" {
+		return ErrNotBridged
+	}
+	return nil
+}
+
+// DetectAnsweringMachine runs the AMD dialplan application with the given
+// options (see `core show application AMD`; may be empty for the amd.conf
+// defaults) and returns the detected status: "HUMAN", "MACHINE", "NOTSURE"
+// or "HANGUP".  The reason for the status is left in the AMDCAUSE channel
+// variable.
+func (a *AGI) DetectAnsweringMachine(opts string) (string, error) {
+	if err := a.execApp("AMD", opts); err != nil {
+		return "", err
+	}
+
+	status, err := a.Get("AMDSTATUS")
+	if err != nil {
+		return "", err
+	}
+	switch status {
+	case "HUMAN", "MACHINE", "NOTSURE", "HANGUP":
+		return status, nil
+	}
+	cause, _ := a.Get("AMDCAUSE")
+	return "", fmt.Errorf("unexpected AMD status %q (cause %q)", status, cause)
+}
+
+// ErrNoSuchConference indicates the ConfBridge conference does not exist
+var ErrNoSuchConference = errors.New("no such conference")
+
+// BridgeCount returns the number of parties in the given ConfBridge
+// conference, from `CONFBRIDGE_INFO(parties,...)`.  ConfBridge destroys a
+// conference once its last party leaves, and Asterisk reports an unknown
+// conference as having no parties: no parties thus means that there is no
+// such conference, for which ErrNoSuchConference is returned.
+func (a *AGI) BridgeCount(bridgeID string) (int, error) {
+	if bridgeID == "" || strings.ContainsAny(bridgeID, "(),${}") {
+		return 0, fmt.Errorf("invalid conference %q", bridgeID)
+	}
+	val, err := a.GetFull("${CONFBRIDGE_INFO(parties," + bridgeID + ")}")
+	if err != nil {
+		return 0, err
+	}
+	if val == "" || val == "0" {
+		return 0, ErrNoSuchConference
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid party count %q", val)
+	}
+	return n, nil
+}
@@ -0,0 +1,500 @@
+package agi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallback(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		err    bool
+	}{
+		{name: "answered", status: "SUCCESS"},
+		{name: "busy", status: "BUSY", err: true},
+		{name: "unanswered", status: "NOANSWER", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			script := "agi_channel: PJSIP/100-00000001\nagi_version: 18.20.0\n\n200 result=0\n200 result=1 (" + tt.status + ")\n"
+			a := New(strings.NewReader(script), &out)
+
+			status, err := a.Callback("PJSIP", "alice", 30*time.Second)
+			if status != tt.status || tt.err != (err != nil) {
+				t.Errorf("got %q, %v; want %q", status, err, tt.status)
+			}
+			want := "EXEC Originate \"PJSIP/alice,app,Bridge,PJSIP/100-00000001,,30\"\nGET VARIABLE ORIGINATE_STATUS\n"
+			if out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestPlayTone(t *testing.T) {
+	tests := []struct {
+		tone     string
+		duration time.Duration
+		sent     []string
+		err      bool
+	}{
+		{tone: "busy", sent: []string{`EXEC Playtones "busy"`}},
+		{
+			tone: "440+480/2000,0/4000", duration: 1500 * time.Millisecond,
+			sent: []string{`EXEC Playtones "440+480/2000,0/4000"`, `EXEC Wait "1.5"`, "EXEC StopPlaytones"},
+		},
+		{tone: "!950/330,!1400/330", sent: []string{`EXEC Playtones "!950/330,!1400/330"`}},
+		{tone: "loud", err: true},
+		{tone: "440;HANGUP", err: true},
+		{tone: "", err: true},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n"+strings.Repeat("200 result=0\n", 3)), &out)
+		err := a.PlayTone(tt.tone, tt.duration)
+		if tt.err != (err != nil) {
+			t.Errorf("%q: got error %v", tt.tone, err)
+		}
+		want := ""
+		if len(tt.sent) > 0 {
+			want = strings.Join(tt.sent, "\n") + "\n"
+		}
+		if out.String() != want {
+			t.Errorf("%q: sent %q, want %q", tt.tone, out.String(), want)
+		}
+	}
+}
+
+func TestMute(t *testing.T) {
+	tests := []struct {
+		direction string
+		mute      string
+		unmute    string
+	}{
+		{"in", `EXEC Set "MUTEAUDIO(in)=on"`, `EXEC Set "MUTEAUDIO(in)=off"`},
+		{"out", `EXEC Set "MUTEAUDIO(out)=on"`, `EXEC Set "MUTEAUDIO(out)=off"`},
+		{"both", `EXEC Set "MUTEAUDIO(all)=on"`, `EXEC Set "MUTEAUDIO(all)=off"`},
+		{direction: "sideways"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=0\n200 result=0\n"), &out)
+		merr, uerr := a.Mute(tt.direction), a.Unmute(tt.direction)
+		if tt.mute == "" {
+			if merr == nil || uerr == nil || out.Len() != 0 {
+				t.Errorf("%q: got %v, %v, sent %q", tt.direction, merr, uerr, out.String())
+			}
+			continue
+		}
+		if merr != nil || uerr != nil {
+			t.Errorf("%q: got %v, %v", tt.direction, merr, uerr)
+		}
+		if want := tt.mute + "\n" + tt.unmute + "\n"; out.String() != want {
+			t.Errorf("%q: sent %q, want %q", tt.direction, out.String(), want)
+		}
+	}
+}
+
+func TestSecureGetData(t *testing.T) {
+	const (
+		mute   = `EXEC Set "MUTEAUDIO(in)=on"`
+		get    = "GET DATA pin 5000 4"
+		unmute = `EXEC Set "MUTEAUDIO(in)=off"`
+	)
+	tests := []struct {
+		name   string
+		script string
+		want   string
+		sent   []string
+		err    bool
+	}{
+		{name: "digits", script: "200 result=0\n200 result=1234\n200 result=0\n", want: "1234", sent: []string{mute, get, unmute}},
+		{name: "hangup", script: "200 result=0\n200 result=-1\n200 result=0\n", sent: []string{mute, get, unmute}, err: true},
+		{name: "unmute failed", script: "200 result=0\n200 result=12\n200 result=-1\n", want: "12", sent: []string{mute, get, unmute}, err: true},
+		{name: "mute failed", script: "200 result=-1\n", sent: []string{mute}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			got, err := a.SecureGetData("pin", 4, 5*time.Second)
+			if got != tt.want || tt.err != (err != nil) {
+				t.Errorf("got %q, %v; want %q", got, err, tt.want)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestIndications(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(a *AGI) error
+		sent string
+	}{
+		{"Ringing", func(a *AGI) error { return a.Ringing() }, "EXEC Ringing\n"},
+		{"Progress", func(a *AGI) error { return a.Progress() }, "EXEC Progress\n"},
+	}
+	for _, tt := range tests {
+		for _, response := range []string{"200 result=0", "200 result=-1"} {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+response+"\n"), &out)
+			err := tt.run(a)
+			if hangup := response == "200 result=-1"; hangup != errors.Is(err, ErrHangup) {
+				t.Errorf("%s on %q: got %v", tt.name, response, err)
+			}
+			if out.String() != tt.sent {
+				t.Errorf("%s: sent %q, want %q", tt.name, out.String(), tt.sent)
+			}
+		}
+	}
+}
+
+func TestSetCodecs(t *testing.T) {
+	tests := []struct {
+		codecs []string
+		sent   string
+	}{
+		{codecs: []string{"opus", "ulaw"}, sent: "EXEC Set \"PJSIP_MEDIA_OFFER(audio)=opus,ulaw\"\n"},
+		{codecs: []string{"g722"}, sent: "EXEC Set \"PJSIP_MEDIA_OFFER(audio)=g722\"\n"},
+		{codecs: []string{"ulaw", "mp3"}},
+		{codecs: []string{"ulaw,alaw"}},
+		{},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=0\n"), &out)
+		err := a.SetCodecs(tt.codecs)
+		if (tt.sent == "") != (err != nil) {
+			t.Errorf("%v: got error %v", tt.codecs, err)
+		}
+		if out.String() != tt.sent {
+			t.Errorf("%v: sent %q, want %q", tt.codecs, out.String(), tt.sent)
+		}
+	}
+}
+
+func TestWaitForFax(t *testing.T) {
+	tests := []struct {
+		status string
+		fax    bool
+		err    error
+		failed bool
+	}{
+		{status: "SUCCESS", fax: true},
+		{status: "TIMEOUT"},
+		{status: "HANGUP", err: ErrHangup},
+		{status: "ERROR", failed: true},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_version: 18.20.0\n\n200 result=0\n200 result=1 ("+tt.status+")\n"), &out)
+		fax, err := a.WaitForFax(3500 * time.Millisecond)
+		if fax != tt.fax || tt.err != nil && !errors.Is(err, tt.err) || tt.err == nil && tt.failed != (err != nil) {
+			t.Errorf("%s: got %v, %v", tt.status, fax, err)
+		}
+		if want := "EXEC WaitForCNG \"1,3.5\"\nGET VARIABLE WAITFORTONESTATUS\n"; out.String() != want {
+			t.Errorf("sent %q, want %q", out.String(), want)
+		}
+	}
+}
+
+func TestCallRecording(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		options string
+		start   string
+	}{
+		{name: "plain", version: "18.20.0", start: `EXEC MixMonitor "/var/spool/calls/1.wav"`},
+		{name: "options", version: "18.20.0", options: "b", start: `EXEC MixMonitor "/var/spool/calls/1.wav,b"`},
+		{name: "legacy", version: "1.4.21", options: "b", start: `EXEC MixMonitor "/var/spool/calls/1.wav|b"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_version: "+tt.version+"\n\n200 result=0\n200 result=0\n"), &out)
+			if err := a.StartCallRecording("/var/spool/calls/1.wav", tt.options); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.StopCallRecording(); err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.start + "\nEXEC StopMixMonitor\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestWithMusic(t *testing.T) {
+	errLookup := errors.New("lookup failed")
+	tests := []struct {
+		name   string
+		class  string
+		script string
+		fn     error
+		sent   []string
+		err    error
+	}{
+		{
+			name:   "default class",
+			script: "200 result=0\n200 result=0\n",
+			sent:   []string{"SET MUSIC ON default", "SET MUSIC OFF"},
+		},
+		{
+			name: "failing function", class: "jazz",
+			script: "200 result=0\n200 result=0\n",
+			fn:     errLookup,
+			sent:   []string{"SET MUSIC ON jazz", "SET MUSIC OFF"},
+			err:    errLookup,
+		},
+		{
+			name:   "music failed",
+			script: "510 Invalid or unknown command\n",
+			sent:   []string{"SET MUSIC ON default"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			ran := false
+			err := a.WithMusic(tt.class, func() error {
+				ran = true
+				return tt.fn
+			})
+			if len(tt.sent) == 1 {
+				if err == nil || ran {
+					t.Errorf("got %v, ran %v", err, ran)
+				}
+			} else if !errors.Is(err, tt.err) || !ran {
+				t.Errorf("got %v, ran %v; want %v", err, ran, tt.err)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestHold(t *testing.T) {
+	var out bytes.Buffer
+	a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=0\n200 result=0\n200 result=-1\n"), &out)
+	if a.IsOnHold() {
+		t.Error("on hold initially")
+	}
+	if err := a.Hold(); err != nil || !a.IsOnHold() {
+		t.Errorf("Hold: got %v, on hold %v", err, a.IsOnHold())
+	}
+	if err := a.Unhold(); err != nil || a.IsOnHold() {
+		t.Errorf("Unhold: got %v, on hold %v", err, a.IsOnHold())
+	}
+	// the state is left as is when the application fails
+	if err := a.Hold(); !errors.Is(err, ErrHangup) || a.IsOnHold() {
+		t.Errorf("Hold after hangup: got %v, on hold %v", err, a.IsOnHold())
+	}
+	if want := "EXEC StartMusicOnHold\nEXEC StopMusicOnHold\nEXEC StartMusicOnHold\n"; out.String() != want {
+		t.Errorf("sent %q, want %q", out.String(), want)
+	}
+}
+
+func TestPark(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		sent   []string
+		err    error
+	}{
+		{
+			name:   "parked",
+			script: "200 result=0\n200 result=1 (701)\n",
+			sent:   []string{"EXEC Park", "GET VARIABLE PARKINGSLOT"},
+		},
+		{
+			name:   "not parked",
+			script: "200 result=0\n200 result=0\n",
+			sent:   []string{"EXEC Park", "GET VARIABLE PARKINGSLOT"},
+			err:    errors.New("failed to park the call"),
+		},
+		{
+			name:   "hangup",
+			script: "200 result=-1\n",
+			sent:   []string{"EXEC Park"},
+			err:    ErrHangup,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_version: 18.20.0\n\n"+tt.script), &out)
+
+			err := a.Park(0)
+			if fmt.Sprint(err) != fmt.Sprint(tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		name     string
+		attended bool
+		exten    string
+		script   string
+		sent     []string
+		status   string
+		err      bool
+	}{
+		{
+			name:   "blind",
+			exten:  "701",
+			script: "200 result=1 (PJSIP/200-00000002)\n200 result=0\n200 result=1 (SUCCESS)\n",
+			sent:   []string{"GET VARIABLE BRIDGEPEER", `EXEC BlindTransfer "701,default"`, "GET VARIABLE BLINDTRANSFERSTATUS"},
+		},
+		{
+			name:   "blind failed",
+			exten:  "701",
+			script: "200 result=1 (PJSIP/200-00000002)\n200 result=0\n200 result=1 (FAILURE)\n",
+			sent:   []string{"GET VARIABLE BRIDGEPEER", `EXEC BlindTransfer "701,default"`, "GET VARIABLE BLINDTRANSFERSTATUS"},
+			err:    true,
+		},
+		{
+			name:   "blind not bridged",
+			exten:  "701",
+			script: "200 result=0\n",
+			sent:   []string{"GET VARIABLE BRIDGEPEER"},
+			err:    true,
+		},
+		{
+			name: "blind no extension",
+			err:  true,
+		},
+		{
+			name:     "attended",
+			attended: true,
+			exten:    "701",
+			script:   "200 result=1 (PJSIP/200-00000002)\n200 result=0\n200 result=0\n200 result=1 (SUCCESS)\n",
+			sent: []string{
+				"GET VARIABLE BRIDGEPEER", `EXEC Set "TRANSFER_CONTEXT=default"`,
+				`EXEC AttendedTransfer "701"`, "GET VARIABLE ATTENDEDTRANSFERSTATUS",
+			},
+			status: "SUCCESS",
+		},
+		{
+			name:     "attended not permitted",
+			attended: true,
+			exten:    "701",
+			script:   "200 result=1 (PJSIP/200-00000002)\n200 result=0\n200 result=0\n200 result=1 (NOTPERMITTED)\n",
+			sent: []string{
+				"GET VARIABLE BRIDGEPEER", `EXEC Set "TRANSFER_CONTEXT=default"`,
+				`EXEC AttendedTransfer "701"`, "GET VARIABLE ATTENDEDTRANSFERSTATUS",
+			},
+			status: "NOTPERMITTED",
+			err:    true,
+		},
+		{
+			name:     "attended no extension",
+			attended: true,
+			err:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_version: 18.20.0\n\n"+tt.script), &out)
+
+			var status string
+			var err error
+			if tt.attended {
+				status, err = a.AttendedTransfer(tt.exten, "default")
+			} else {
+				err = a.BlindTransfer(tt.exten, "default")
+			}
+			if status != tt.status || tt.err != (err != nil) {
+				t.Errorf("got %q, %v; want %q", status, err, tt.status)
+			}
+			want := ""
+			if len(tt.sent) > 0 {
+				want = strings.Join(tt.sent, "\n") + "\n"
+			}
+			if out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestDetectAnsweringMachine(t *testing.T) {
+	tests := []struct {
+		status string
+		sent   []string
+		err    bool
+	}{
+		{status: "HUMAN"},
+		{status: "MACHINE"},
+		{status: "NOTSURE"},
+		{status: "HANGUP"},
+		{status: "", sent: []string{"GET VARIABLE AMDCAUSE"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			var out bytes.Buffer
+			script := "200 result=0\n200 result=1 (" + tt.status + ")\n200 result=1 (TOOLONG-5000)\n"
+			a := New(strings.NewReader("agi_version: 18.20.0\n\n"+script), &out)
+
+			status, err := a.DetectAnsweringMachine("2500,1500")
+			if tt.err {
+				if err == nil || status != "" {
+					t.Errorf("got %q, %v; want an error", status, err)
+				}
+			} else if status != tt.status || err != nil {
+				t.Errorf("got %q, %v; want %q", status, err, tt.status)
+			}
+			sent := append([]string{`EXEC AMD "2500,1500"`, "GET VARIABLE AMDSTATUS"}, tt.sent...)
+			if want := strings.Join(sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestBridgeCount(t *testing.T) {
+	tests := []struct {
+		bridge   string
+		response string
+		sent     string
+		want     int
+		err      error
+	}{
+		{bridge: "sales", response: "200 result=1 (3)", sent: `GET FULL VARIABLE "${CONFBRIDGE_INFO(parties,sales)}"` + "\n", want: 3},
+		{bridge: "gone", response: "200 result=1 (0)", sent: `GET FULL VARIABLE "${CONFBRIDGE_INFO(parties,gone)}"` + "\n", err: ErrNoSuchConference},
+		{bridge: "gone", response: "200 result=0", sent: `GET FULL VARIABLE "${CONFBRIDGE_INFO(parties,gone)}"` + "\n", err: ErrNoSuchConference},
+		{bridge: "sales", response: "200 result=1 (many)", sent: `GET FULL VARIABLE "${CONFBRIDGE_INFO(parties,sales)}"` + "\n", err: errors.New(`invalid party count "many"`)},
+		{bridge: "x)}${SHELL(id", err: errors.New(`invalid conference "x)}${SHELL(id"`)},
+		{bridge: "", err: errors.New(`invalid conference ""`)},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &out)
+		got, err := a.BridgeCount(tt.bridge)
+		if got != tt.want || fmt.Sprint(err) != fmt.Sprint(tt.err) {
+			t.Errorf("%q: got %d, %v; want %d, %v", tt.bridge, got, err, tt.want, tt.err)
+		}
+		if out.String() != tt.sent {
+			t.Errorf("%q: sent %q, want %q", tt.bridge, out.String(), tt.sent)
+		}
+	}
+}
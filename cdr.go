@@ -0,0 +1,34 @@
+package agi
+
+// SetCDRUserField sets the CDR userfield of the channel.
+func (a *AGI) SetCDRUserField(value string) error {
+	return a.execSet("CDR(userfield)", value)
+}
+
+// AppendCDRUserField appends value to the CDR userfield of the channel.  The
+// current userfield is read then written back with value appended: Asterisk
+// only expands variables in EXEC arguments when AGIEXECFULL is set, so the
+// expansion cannot be left to Set.
+func (a *AGI) AppendCDRUserField(value string) error {
+	current, err := a.Get("CDR(userfield)")
+	if err != nil {
+		return err
+	}
+	return a.execSet("CDR(userfield)", current+value)
+}
+
+// SetAccountCode sets the account code of the channel, which is recorded
+// in its CDR.
+func (a *AGI) SetAccountCode(code string) error {
+	return a.execSet("CHANNEL(accountcode)", code)
+}
+
+// execSet runs the Set dialplan application, assigning value to the given
+// variable or function.  It returns ErrHangup if the channel hung up.
+func (a *AGI) execSet(name, value string) error {
+	resp := a.Command(a.timeouts.Variable, "EXEC", "Set", quoteArg(name+"="+value))
+	if resp.Error == nil && resp.Result < 0 {
+		return ErrHangup
+	}
+	return resp.Err()
+}
@@ -0,0 +1,66 @@
+package agi
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCDR(t *testing.T) {
+	const dead = "511 Command Not Permitted on a dead channel or intercept routine\n"
+	tests := []struct {
+		name   string
+		run    func(a *AGI) error
+		script string
+		want   []string
+		hangup string
+	}{
+		{
+			name:   "set userfield",
+			run:    func(a *AGI) error { return a.SetCDRUserField("vip") },
+			script: "200 result=0\n",
+			want:   []string{`EXEC Set "CDR(userfield)=vip"`},
+			hangup: "200 result=-1\n",
+		},
+		{
+			name:   "append userfield",
+			run:    func(a *AGI) error { return a.AppendCDRUserField(";vip") },
+			script: "200 result=1 (gold)\n200 result=0\n",
+			want:   []string{"GET VARIABLE CDR(userfield)", `EXEC Set "CDR(userfield)=gold;vip"`},
+			hangup: dead,
+		},
+		{
+			name:   "append to an empty userfield",
+			run:    func(a *AGI) error { return a.AppendCDRUserField("vip") },
+			script: "200 result=0\n200 result=0\n",
+			want:   []string{"GET VARIABLE CDR(userfield)", `EXEC Set "CDR(userfield)=vip"`},
+			hangup: "200 result=1 (gold)\n200 result=-1\n",
+		},
+		{
+			name:   "account code",
+			run:    func(a *AGI) error { return a.SetAccountCode("acme") },
+			script: "200 result=0\n",
+			want:   []string{`EXEC Set "CHANNEL(accountcode)=acme"`},
+			hangup: "200 result=-1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" hangup", func(t *testing.T) {
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.hangup), &bytes.Buffer{})
+			if err := tt.run(a); !errors.Is(err, ErrHangup) {
+				t.Errorf("got %v, want ErrHangup", err)
+			}
+		})
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			if err := tt.run(a); err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Join(tt.want, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package agi
+
+import (
+	"fmt"
+	"net"
+)
+
+// ConnectedLine returns the name and number of the connected party of the
+// channel, as displayed to the caller.  Unavailable values are empty.
+func (a *AGI) ConnectedLine() (name, number string) {
+	name, _ = a.GetFull("${CONNECTEDLINE(name)}")
+	number, _ = a.GetFull("${CONNECTEDLINE(num)}")
+	return name, number
+}
+
+// SetConnectedLine updates the connected party displayed to the caller, for
+// instance after a transfer.  A single update is sent for both values.
+func (a *AGI) SetConnectedLine(name, number string) error {
+	// the "i" option defers the update until the number is set
+	if err := a.Set("CONNECTEDLINE(name,i)", quoteArg(name)); err != nil {
+		return err
+	}
+	return a.Set("CONNECTEDLINE(num)", quoteArg(number))
+}
+
+// IsEncrypted reports whether the media of the channel is encrypted.  It
+// checks `CHANNEL(secure_bridge_media)`, set when the channel requires SRTP,
+// then, for PJSIP channels, the media encryption configured for the endpoint
+// (`CHANNEL(rtp,...)` does not report it).  It returns false when the
+// status cannot be determined.
+func (a *AGI) IsEncrypted() (bool, error) {
+	secure, err := a.GetFull("${CHANNEL(secure_bridge_media)}")
+	if err != nil {
+		return false, err
+	}
+	if secure == "1" {
+		return true, nil
+	}
+	if a.ChannelType() != "PJSIP" {
+		return false, nil
+	}
+
+	encryption, err := a.EndpointDetail("media_encryption")
+	if err != nil {
+		return false, err
+	}
+	switch encryption {
+	case "sdes", "dtls":
+		return true, nil
+	}
+	return false, nil
+}
+
+// PeerInfo returns the IP address and User-Agent of the SIP peer the channel
+// comes from, e.g. for fraud detection: `CHANNEL(pjsip,remote_addr)` and the
+// User-Agent header for PJSIP channels, `CHANNEL(peerip)` and
+// `CHANNEL(useragent)` for chan_sip ones.  Unavailable values are empty;
+// only failures to query Asterisk are returned as errors.
+func (a *AGI) PeerInfo() (ip string, userAgent string, err error) {
+	addrExpr, uaExpr := "${CHANNEL(pjsip,remote_addr)}", "${PJSIP_HEADER(read,User-Agent)}"
+	if a.ChannelType() == "SIP" {
+		addrExpr, uaExpr = "${CHANNEL(peerip)}", "${CHANNEL(useragent)}"
+	}
+
+	if ip, err = a.GetFull(addrExpr); err != nil {
+		return "", "", err
+	}
+	// remote_addr includes the port
+	if host, _, serr := net.SplitHostPort(ip); serr == nil {
+		ip = host
+	}
+	if userAgent, err = a.GetFull(uaExpr); err != nil {
+		return "", "", err
+	}
+	return ip, userAgent, nil
+}
+
+// endpointFields are the pjsip.conf endpoint options EndpointDetail reads
+var endpointFields = map[string]bool{
+	"accountcode":          true,
+	"allow":                true,
+	"aors":                 true,
+	"auth":                 true,
+	"call_group":           true,
+	"callerid":             true,
+	"callerid_privacy":     true,
+	"context":              true,
+	"device_state_busy_at": true,
+	"direct_media":         true,
+	"disallow":             true,
+	"dtmf_mode":            true,
+	"force_rport":          true,
+	"from_domain":          true,
+	"from_user":            true,
+	"identify_by":          true,
+	"language":             true,
+	"mailboxes":            true,
+	"media_encryption":     true,
+	"moh_suggest":          true,
+	"outbound_auth":        true,
+	"pickup_group":         true,
+	"rewrite_contact":      true,
+	"rtp_symmetric":        true,
+	"send_pai":             true,
+	"send_rpid":            true,
+	"t38_udptl":            true,
+	"transport":            true,
+	"trust_id_inbound":     true,
+	"trust_id_outbound":    true,
+}
+
+// EndpointDetail returns the given option of the pjsip.conf configuration
+// of the channel's endpoint, such as "context" or "allow", from
+// `PJSIP_ENDPOINT`.  Only PJSIP channels have an endpoint.
+func (a *AGI) EndpointDetail(field string) (string, error) {
+	if !endpointFields[field] {
+		return "", fmt.Errorf("unknown endpoint field %q", field)
+	}
+	return a.GetFull("${PJSIP_ENDPOINT(${CHANNEL(endpoint)}," + field + ")}")
+}
@@ -0,0 +1,176 @@
+package agi
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestConnectedLine(t *testing.T) {
+	tests := []struct {
+		script       string
+		name, number string
+	}{
+		{"200 result=1 (Alice Smith)\n200 result=1 (5551234)\n", "Alice Smith", "5551234"},
+		{"200 result=0\n200 result=1 (5551234)\n", "", "5551234"},
+		{"200 result=0\n200 result=0\n", "", ""},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+		name, number := a.ConnectedLine()
+		if name != tt.name || number != tt.number {
+			t.Errorf("got %q, %q; want %q, %q", name, number, tt.name, tt.number)
+		}
+		want := "GET FULL VARIABLE \"${CONNECTEDLINE(name)}\"\nGET FULL VARIABLE \"${CONNECTEDLINE(num)}\"\n"
+		if out.String() != want {
+			t.Errorf("sent %q, want %q", out.String(), want)
+		}
+	}
+}
+
+func TestSetConnectedLine(t *testing.T) {
+	tests := []struct {
+		script string
+		sent   []string
+		err    bool
+	}{
+		{
+			script: "200 result=1\n200 result=1\n",
+			sent:   []string{`SET VARIABLE CONNECTEDLINE(name,i) "Sales \"EU\""`, `SET VARIABLE CONNECTEDLINE(num) "100"`},
+		},
+		{
+			script: "200 result=0\n",
+			sent:   []string{`SET VARIABLE CONNECTEDLINE(name,i) "Sales \"EU\""`},
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+		if err := a.SetConnectedLine(`Sales "EU"`, "100"); tt.err != (err != nil) {
+			t.Errorf("got error %v", err)
+		}
+		if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+			t.Errorf("sent %q, want %q", out.String(), want)
+		}
+	}
+}
+
+func TestPeerInfo(t *testing.T) {
+	tests := []struct {
+		name          string
+		kind          string
+		script        string
+		sent          []string
+		ip, userAgent string
+		err           bool
+	}{
+		{
+			name: "PJSIP", kind: "PJSIP",
+			script: "200 result=1 (203.0.113.7:5060)\n200 result=1 (Zoiper rv2.10.20.2)\n",
+			sent:   []string{`GET FULL VARIABLE "${CHANNEL(pjsip,remote_addr)}"`, `GET FULL VARIABLE "${PJSIP_HEADER(read,User-Agent)}"`},
+			ip:     "203.0.113.7", userAgent: "Zoiper rv2.10.20.2",
+		},
+		{
+			name: "IPv6", kind: "PJSIP",
+			script: "200 result=1 ([2001:db8::1]:5060)\n200 result=0\n",
+			sent:   []string{`GET FULL VARIABLE "${CHANNEL(pjsip,remote_addr)}"`, `GET FULL VARIABLE "${PJSIP_HEADER(read,User-Agent)}"`},
+			ip:     "2001:db8::1",
+		},
+		{
+			name: "chan_sip", kind: "SIP",
+			script: "200 result=1 (198.51.100.2)\n200 result=1 (Linphone/5.0)\n",
+			sent:   []string{`GET FULL VARIABLE "${CHANNEL(peerip)}"`, `GET FULL VARIABLE "${CHANNEL(useragent)}"`},
+			ip:     "198.51.100.2", userAgent: "Linphone/5.0",
+		},
+		{
+			name: "unavailable", kind: "PJSIP",
+			script: "200 result=0\n200 result=0\n",
+			sent:   []string{`GET FULL VARIABLE "${CHANNEL(pjsip,remote_addr)}"`, `GET FULL VARIABLE "${PJSIP_HEADER(read,User-Agent)}"`},
+		},
+		{
+			name: "hangup", kind: "PJSIP",
+			script: "511 Command Not Permitted on a dead channel or intercept routine\n",
+			sent:   []string{`GET FULL VARIABLE "${CHANNEL(pjsip,remote_addr)}"`},
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_type: "+tt.kind+"\n\n"+tt.script), &out)
+			ip, userAgent, err := a.PeerInfo()
+			if ip != tt.ip || userAgent != tt.userAgent || tt.err != (err != nil) {
+				t.Errorf("got %q, %q, %v; want %q, %q", ip, userAgent, err, tt.ip, tt.userAgent)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestIsEncrypted(t *testing.T) {
+	const secure = `GET FULL VARIABLE "${CHANNEL(secure_bridge_media)}"`
+	const encryption = `GET FULL VARIABLE "${PJSIP_ENDPOINT(${CHANNEL(endpoint)},media_encryption)}"`
+	tests := []struct {
+		name   string
+		kind   string
+		script string
+		sent   []string
+		want   bool
+	}{
+		{name: "secure bridge", kind: "PJSIP", script: "200 result=1 (1)\n", sent: []string{secure}, want: true},
+		{name: "dtls", kind: "PJSIP", script: "200 result=1 (0)\n200 result=1 (dtls)\n", sent: []string{secure, encryption}, want: true},
+		{name: "sdes", kind: "PJSIP", script: "200 result=0\n200 result=1 (sdes)\n", sent: []string{secure, encryption}, want: true},
+		{name: "plain RTP", kind: "PJSIP", script: "200 result=1 (0)\n200 result=1 (no)\n", sent: []string{secure, encryption}},
+		{name: "unknown", kind: "PJSIP", script: "200 result=0\n200 result=0\n", sent: []string{secure, encryption}},
+		{name: "not PJSIP", kind: "IAX2", script: "200 result=0\n", sent: []string{secure}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_type: "+tt.kind+"\n\n"+tt.script), &out)
+			got, err := a.IsEncrypted()
+			if err != nil || got != tt.want {
+				t.Errorf("got %v, %v; want %v", got, err, tt.want)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestEndpointDetail(t *testing.T) {
+	tests := []struct {
+		field    string
+		response string
+		sent     string
+		want     string
+		err      bool
+	}{
+		{
+			field: "context", response: "200 result=1 (from-internal)",
+			sent: `GET FULL VARIABLE "${PJSIP_ENDPOINT(${CHANNEL(endpoint)},context)}"` + "\n", want: "from-internal",
+		},
+		{
+			field: "allow", response: "200 result=1 ((codec2|ulaw|alaw))",
+			sent: `GET FULL VARIABLE "${PJSIP_ENDPOINT(${CHANNEL(endpoint)},allow)}"` + "\n", want: "(codec2|ulaw|alaw)",
+		},
+		{field: "password", err: true},
+		{field: "context)},${SHELL(id)", err: true},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_type: PJSIP\n\n"+tt.response+"\n"), &out)
+		got, err := a.EndpointDetail(tt.field)
+		if got != tt.want || tt.err != (err != nil) {
+			t.Errorf("%q: got %q, %v; want %q", tt.field, got, err, tt.want)
+		}
+		if out.String() != tt.sent {
+			t.Errorf("%q: sent %q, want %q", tt.field, out.String(), tt.sent)
+		}
+	}
+}
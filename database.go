@@ -0,0 +1,72 @@
+package agi
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrNoSuchKey indicates the requested key does not exist in the Asterisk database
+var ErrNoSuchKey = errors.New("no such key")
+
+// DatabaseGet returns the value of family/key in the Asterisk database
+// (AstDB), or ErrNoSuchKey if it does not exist.
+func (a *AGI) DatabaseGet(family, key string) (string, error) {
+	resp := a.Command(a.timeouts.Variable, "DATABASE GET", quoteArg(family), quoteArg(key))
+	if resp.Error != nil {
+		return "", resp.Error
+	}
+	if resp.Result == 0 {
+		return "", ErrNoSuchKey
+	}
+	return resp.Value, nil
+}
+
+// DatabasePut stores value as family/key in the Asterisk database.
+func (a *AGI) DatabasePut(family, key, value string) error {
+	resp := a.Command(a.timeouts.Variable, "DATABASE PUT", quoteArg(family), quoteArg(key), quoteArg(value))
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if resp.Result == 0 {
+		return fmt.Errorf("failed to put %s/%s", family, key)
+	}
+	return nil
+}
+
+// DatabaseDel deletes family/key from the Asterisk database.
+func (a *AGI) DatabaseDel(family, key string) error {
+	resp := a.Command(a.timeouts.Variable, "DATABASE DEL", quoteArg(family), quoteArg(key))
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if resp.Result == 0 {
+		return ErrNoSuchKey
+	}
+	return nil
+}
+
+// DatabaseIncr adds delta to the integer stored as family/key in the
+// Asterisk database, which is taken as 0 if it does not exist, and returns
+// the new value.  The read and the write are separate commands, so the
+// increment is not atomic across concurrent AGI sessions unless they are
+// serialized in the dialplan (e.g. with LOCK()).
+func (a *AGI) DatabaseIncr(family, key string, delta int) (int, error) {
+	n := 0
+	v, err := a.DatabaseGet(family, key)
+	switch err {
+	case nil:
+		if n, err = strconv.Atoi(v); err != nil {
+			return 0, fmt.Errorf("%s/%s is not an integer: %q", family, key, v)
+		}
+	case ErrNoSuchKey:
+	default:
+		return 0, err
+	}
+
+	n += delta
+	if err := a.DatabasePut(family, key, strconv.Itoa(n)); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,110 @@
+package agi
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDatabase(t *testing.T) {
+	tests := []struct {
+		name     string
+		run      func(a *AGI) (string, error)
+		response string
+		sent     string
+		want     string
+		err      error
+		failed   bool
+	}{
+		{
+			name:     "get",
+			run:      func(a *AGI) (string, error) { return a.DatabaseGet("cidname", "5551234") },
+			response: "200 result=1 (Alice Smith)",
+			sent:     `DATABASE GET "cidname" "5551234"`,
+			want:     "Alice Smith",
+		},
+		{
+			name:     "get missing",
+			run:      func(a *AGI) (string, error) { return a.DatabaseGet("cidname", "0") },
+			response: "200 result=0",
+			sent:     `DATABASE GET "cidname" "0"`,
+			err:      ErrNoSuchKey,
+		},
+		{
+			name:     "put",
+			run:      func(a *AGI) (string, error) { return "", a.DatabasePut("blocked", "555", `a "b"`) },
+			response: "200 result=1",
+			sent:     `DATABASE PUT "blocked" "555" "a \"b\""`,
+		},
+		{
+			name:     "put failed",
+			run:      func(a *AGI) (string, error) { return "", a.DatabasePut("blocked", "555", "1") },
+			response: "200 result=0",
+			sent:     `DATABASE PUT "blocked" "555" "1"`,
+			failed:   true,
+		},
+		{
+			name:     "del",
+			run:      func(a *AGI) (string, error) { return "", a.DatabaseDel("blocked", "555") },
+			response: "200 result=1",
+			sent:     `DATABASE DEL "blocked" "555"`,
+		},
+		{
+			name:     "del missing",
+			run:      func(a *AGI) (string, error) { return "", a.DatabaseDel("blocked", "555") },
+			response: "200 result=0",
+			sent:     `DATABASE DEL "blocked" "555"`,
+			err:      ErrNoSuchKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &out)
+			got, err := tt.run(a)
+			if tt.failed {
+				if err == nil {
+					t.Error("no error")
+				}
+			} else if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("got %q, %v; want %q, %v", got, err, tt.want, tt.err)
+			}
+			if out.String() != tt.sent+"\n" {
+				t.Errorf("sent %q, want %q", out.String(), tt.sent+"\n")
+			}
+		})
+	}
+}
+
+func TestDatabaseIncr(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   int
+		put    string
+		err    bool
+	}{
+		{name: "existing", script: "200 result=1 (41)\n200 result=1\n", want: 42, put: `DATABASE PUT "calls" "today" "42"`},
+		{name: "missing", script: "200 result=0\n200 result=1\n", want: 1, put: `DATABASE PUT "calls" "today" "1"`},
+		{name: "not a number", script: "200 result=1 (many)\n", err: true},
+		{name: "put failed", script: "200 result=1 (1)\n200 result=0\n", err: true, put: `DATABASE PUT "calls" "today" "2"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			got, err := a.DatabaseIncr("calls", "today", 1)
+			if got != tt.want || tt.err != (err != nil) {
+				t.Errorf("got %d, %v; want %d", got, err, tt.want)
+			}
+			want := `DATABASE GET "calls" "today"` + "\n"
+			if tt.put != "" {
+				want += tt.put + "\n"
+			}
+			if out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package agi
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// eagiFormats are the audio formats an EAGI stream may be in
+var eagiFormats = map[string]bool{
+	"slin":    true,
+	"slin12":  true,
+	"slin16":  true,
+	"slin24":  true,
+	"slin32":  true,
+	"slin44":  true,
+	"slin48":  true,
+	"slin96":  true,
+	"slin192": true,
+	"ulaw":    true,
+	"alaw":    true,
+	"g722":    true,
+	"gsm":     true,
+}
+
+// SetReadFormat requests the audio format (e.g. "slin16" or "ulaw") of the
+// EAGI stream through the `EAGI_AUDIO_FORMAT` channel variable.  Asterisk
+// reads it when the EAGI application starts, so it takes effect for EAGI
+// scripts subsequently run on the channel, not for the current stream.
+func (a *AGI) SetReadFormat(format string) error {
+	if !eagiFormats[format] {
+		return fmt.Errorf("unsupported audio format %q", format)
+	}
+	return a.execSet("EAGI_AUDIO_FORMAT", format)
+}
+
+// EAGIStream reads the audio of an EAGI stream, in signed linear 16-bit
+// little-endian PCM (slin formats), in frames of a given number of samples.
+type EAGIStream struct {
+	r   io.Reader
+	buf []byte
+}
+
+// NewEAGIStream returns an EAGIStream reading from r, typically AGI.EAGI().
+func NewEAGIStream(r io.Reader) *EAGIStream {
+	return &EAGIStream{r: r}
+}
+
+// read reads exactly n samples
+func (s *EAGIStream) read(n int) ([]byte, error) {
+	if cap(s.buf) < 2*n {
+		s.buf = make([]byte, 2*n)
+	}
+	b := s.buf[:2*n]
+	if _, err := io.ReadFull(s.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ReadFrame reads a frame of the given number of mono samples.
+func (s *EAGIStream) ReadFrame(samples int) ([]int16, error) {
+	b, err := s.read(samples)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]int16, samples)
+	for i := range frame {
+		frame[i] = int16(binary.LittleEndian.Uint16(b[2*i:]))
+	}
+	return frame, nil
+}
+
+// ReadStereoFrame reads a frame of the given number of samples per channel
+// from a dual-channel stream, whose samples interleave the left and right
+// channels, and returns each channel separately.
+func (s *EAGIStream) ReadStereoFrame(samples int) (left, right []int16, err error) {
+	b, err := s.read(2 * samples)
+	if err != nil {
+		return nil, nil, err
+	}
+	left = make([]int16, samples)
+	right = make([]int16, samples)
+	for i := 0; i < samples; i++ {
+		left[i] = int16(binary.LittleEndian.Uint16(b[4*i:]))
+		right[i] = int16(binary.LittleEndian.Uint16(b[4*i+2:]))
+	}
+	return left, right, nil
+}
+
+// defaultEAGIFormat is the format of the EAGI stream when it cannot be determined
+const defaultEAGIFormat = "slin"
+
+// EAGIFormat returns the audio format of the EAGI stream, such as "slin" (8
+// kHz) or "slin16" (16 kHz), from the read format of the channel.  It
+// defaults to "slin" when the session is not EAGI (`agi_enhanced`) or the
+// format cannot be determined.
+func (a *AGI) EAGIFormat() string {
+	if v, _ := a.Variable("agi_enhanced"); v == "" || v == "0.0" {
+		return defaultEAGIFormat
+	}
+	format, err := a.GetFull("${CHANNEL(audioreadformat)}")
+	if err != nil || !eagiFormats[format] {
+		return defaultEAGIFormat
+	}
+	return format
+}
+
+// eagiTeeBuffer is the number of chunks of audio buffered for each writer of
+// EAGITee before it is considered too slow
+const eagiTeeBuffer = 64
+
+// EAGITee reads the EAGI stream and copies the audio to each of the given
+// writers, until the stream ends or the channel hangs up or the session is
+// closed, which is noticed between reads.  Each writer is fed from its own
+// goroutine with a bounded buffer: a writer which fails, or falls too far
+// behind, is detached so that it does not hold up the others, and the first
+// such error is returned once the stream ends.
+func (a *AGI) EAGITee(writers ...io.Writer) error {
+	r := a.EAGI()
+	if r == nil {
+		return errors.New("no EAGI stream")
+	}
+
+	type sink struct {
+		c   chan []byte
+		err error
+	}
+	sinks := make([]*sink, len(writers))
+	var wg sync.WaitGroup
+	for i, w := range writers {
+		s := &sink{c: make(chan []byte, eagiTeeBuffer)}
+		sinks[i] = s
+		wg.Add(1)
+		go func(w io.Writer) {
+			defer wg.Done()
+			for b := range s.c {
+				if s.err != nil {
+					continue
+				}
+				if _, err := w.Write(b); err != nil {
+					s.err = err
+				}
+			}
+		}(w)
+	}
+
+	var slow error
+	done := a.doneC()
+	buf := make([]byte, 4096)
+	var rerr error
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+		default:
+		}
+
+		n, err := r.Read(buf)
+		if n > 0 {
+			for i, s := range sinks {
+				if s.c == nil {
+					continue
+				}
+				select {
+				case s.c <- append([]byte(nil), buf[:n]...):
+				default:
+					close(s.c)
+					s.c = nil
+					if slow == nil {
+						slow = fmt.Errorf("EAGI writer %d too slow", i)
+					}
+				}
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				rerr = err
+			}
+			break
+		}
+	}
+
+	for _, s := range sinks {
+		if s.c != nil {
+			close(s.c)
+		}
+	}
+	wg.Wait()
+
+	if rerr != nil {
+		return rerr
+	}
+	for _, s := range sinks {
+		if s.err != nil {
+			return s.err
+		}
+	}
+	return slow
+}
+
+// captureDigitPoll bounds each wait for a digit of CaptureUntilDTMF, so that
+// the context is checked regularly
+const captureDigitPoll = time.Second
+
+// CaptureUntilDTMF copies the EAGI audio to w while waiting for the caller to
+// press a digit, and returns the digit once pressed, which stops the
+// capture.  It also stops, with the context error, once the context is done,
+// or with the error of the stream or of w.  Nothing is written to w after it
+// returns, though the capture goroutine may still consume one more read of
+// the stream.
+func (a *AGI) CaptureUntilDTMF(ctx context.Context, w io.Writer) (digit string, err error) {
+	r := a.EAGI()
+	if r == nil {
+		return "", errors.New("no EAGI stream")
+	}
+
+	var mu sync.Mutex
+	stopped := false
+	errC := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			mu.Lock()
+			if stopped {
+				mu.Unlock()
+				return
+			}
+			if n > 0 {
+				if _, werr := w.Write(buf[:n]); werr != nil && err == nil {
+					err = werr
+				}
+			}
+			mu.Unlock()
+			if err != nil {
+				errC <- err
+				return
+			}
+		}
+	}()
+	defer func() {
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+	}()
+
+	for {
+		select {
+		case err := <-errC:
+			if err == io.EOF {
+				err = errors.New("EAGI stream ended")
+			}
+			return "", err
+		default:
+		}
+
+		wait, err := a.budget(ctx, captureDigitPoll)
+		if err != nil {
+			return "", err
+		}
+		digit, err := a.WaitForDigit(wait)
+		if err != nil || digit != "" {
+			return digit, err
+		}
+	}
+}
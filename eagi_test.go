@@ -0,0 +1,265 @@
+package agi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEAGIStream(t *testing.T) {
+	// samples 1, -2, 3, -4, in little-endian order
+	data := []byte{0x01, 0x00, 0xfe, 0xff, 0x03, 0x00, 0xfc, 0xff}
+
+	tests := []struct {
+		name  string
+		read  func(s *EAGIStream) ([][]int16, error)
+		want  [][]int16
+		ended bool
+	}{
+		{
+			name: "mono",
+			read: func(s *EAGIStream) ([][]int16, error) {
+				a, err := s.ReadFrame(2)
+				if err != nil {
+					return nil, err
+				}
+				b, err := s.ReadFrame(2)
+				return [][]int16{a, b}, err
+			},
+			want: [][]int16{{1, -2}, {3, -4}},
+		},
+		{
+			name: "stereo",
+			read: func(s *EAGIStream) ([][]int16, error) {
+				left, right, err := s.ReadStereoFrame(2)
+				return [][]int16{left, right}, err
+			},
+			want: [][]int16{{1, 3}, {-2, -4}},
+		},
+		{
+			name: "short frame",
+			read: func(s *EAGIStream) ([][]int16, error) {
+				frame, err := s.ReadFrame(5)
+				return [][]int16{frame}, err
+			},
+			ended: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.read(NewEAGIStream(bytes.NewReader(data)))
+			if tt.ended {
+				if err != io.ErrUnexpectedEOF {
+					t.Errorf("got %v, want io.ErrUnexpectedEOF", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !slices.Equal(got[i], tt.want[i]) {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSetReadFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		sent   string
+		err    bool
+	}{
+		{format: "slin16", sent: "EXEC Set \"EAGI_AUDIO_FORMAT=slin16\"\n"},
+		{format: "ulaw", sent: "EXEC Set \"EAGI_AUDIO_FORMAT=ulaw\"\n"},
+		{format: "mp3", err: true},
+		{format: "slin16,x", err: true},
+		{format: "", err: true},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=0\n"), &out)
+		if err := a.SetReadFormat(tt.format); tt.err != (err != nil) {
+			t.Errorf("%q: got %v", tt.format, err)
+		}
+		if out.String() != tt.sent {
+			t.Errorf("%q: sent %q, want %q", tt.format, out.String(), tt.sent)
+		}
+	}
+}
+
+func TestEAGIFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    string
+		script string
+		sent   string
+		want   string
+	}{
+		{
+			name: "not enhanced",
+			env:  "agi_enhanced: 0.0\n",
+			want: "slin",
+		},
+		{
+			name:   "wideband",
+			env:    "agi_enhanced: 1.0\n",
+			script: "200 result=1 (slin16)\n",
+			sent:   "GET FULL VARIABLE \"${CHANNEL(audioreadformat)}\"\n",
+			want:   "slin16",
+		},
+		{
+			name:   "unknown",
+			env:    "agi_enhanced: 1.0\n",
+			script: "200 result=1 (opus)\n",
+			sent:   "GET FULL VARIABLE \"${CHANNEL(audioreadformat)}\"\n",
+			want:   "slin",
+		},
+		{
+			name:   "unset",
+			env:    "agi_enhanced: 1.0\n",
+			script: "200 result=0\n",
+			sent:   "GET FULL VARIABLE \"${CHANNEL(audioreadformat)}\"\n",
+			want:   "slin",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n"+tt.env+"\n"+tt.script), &out)
+			if got := a.EAGIFormat(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if out.String() != tt.sent {
+				t.Errorf("sent %q, want %q", out.String(), tt.sent)
+			}
+		})
+	}
+}
+
+func TestEAGITee(t *testing.T) {
+	audio := bytes.Repeat([]byte{0x01, 0x00, 0xfe, 0xff}, 3000)
+
+	var transcriber, recorder bytes.Buffer
+	a := NewWithStreams(strings.NewReader("agi_uniqueid: 1\n\n"), &bytes.Buffer{}, []io.Reader{bytes.NewReader(audio)})
+	if err := a.EAGITee(&transcriber, &recorder); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(transcriber.Bytes(), audio) || !bytes.Equal(recorder.Bytes(), audio) {
+		t.Errorf("got %d and %d bytes, want %d", transcriber.Len(), recorder.Len(), len(audio))
+	}
+
+	// a failing writer does not stop the others
+	failed := errors.New("disk full")
+	recorder.Reset()
+	a = NewWithStreams(strings.NewReader("agi_uniqueid: 1\n\n"), &bytes.Buffer{}, []io.Reader{bytes.NewReader(audio)})
+	err := a.EAGITee(writerFunc(func(p []byte) (int, error) { return 0, failed }), &recorder)
+	if !errors.Is(err, failed) {
+		t.Errorf("got %v, want %v", err, failed)
+	}
+	if !bytes.Equal(recorder.Bytes(), audio) {
+		t.Errorf("got %d bytes, want %d", recorder.Len(), len(audio))
+	}
+
+	// nor does a stuck one, beyond its buffer: the stream is read 4 bytes at
+	// a time, each once the previous ones reached the other writer
+	short := audio[:4*(eagiTeeBuffer+16)]
+	var fast lockedBuffer
+	release := make(chan struct{})
+	stuck := writerFunc(func(p []byte) (int, error) {
+		<-release
+		return len(p), nil
+	})
+	sent := 0
+	paced := readerFunc(func(p []byte) (int, error) {
+		for len(fast.String()) < sent {
+			time.Sleep(100 * time.Microsecond)
+		}
+		if sent == len(short) {
+			close(release)
+			return 0, io.EOF
+		}
+		n := copy(p[:4], short[sent:])
+		sent += n
+		return n, nil
+	})
+	a = NewWithStreams(strings.NewReader("agi_uniqueid: 1\n\n"), &bytes.Buffer{}, []io.Reader{paced})
+	if err := a.EAGITee(stuck, &fast); err == nil {
+		t.Error("no error for a stuck writer")
+	}
+	if fast.String() != string(short) {
+		t.Errorf("got %d bytes, want %d", len(fast.String()), len(short))
+	}
+
+	a = New(strings.NewReader("agi_uniqueid: 1\n\n"), &bytes.Buffer{})
+	if err := a.EAGITee(&recorder); err == nil {
+		t.Error("no error without an EAGI stream")
+	}
+}
+
+// readerFunc is an io.Reader calling the function
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestCaptureUntilDTMF(t *testing.T) {
+	audio := bytes.Repeat([]byte{0x01, 0x00, 0xfe, 0xff}, 500)
+
+	// the stream sends the audio, then nothing until the capture stops; the
+	// digit arrives once the audio was captured
+	stream, closer := silentReader(string(audio))
+	defer closer.Close() // nolint: errcheck
+	var captured lockedBuffer
+	script := "200 result=0\n200 result=35\n"
+	commands := io.MultiReader(strings.NewReader("agi_uniqueid: 1\n\n"), readerFunc(func(p []byte) (int, error) {
+		for len(captured.String()) < len(audio) {
+			time.Sleep(time.Millisecond)
+		}
+		n := copy(p, script)
+		script = script[n:]
+		if n == 0 {
+			return 0, io.EOF
+		}
+		return n, nil
+	}))
+	var out bytes.Buffer
+	a := NewWithStreams(commands, &out, []io.Reader{stream})
+
+	digit, err := a.CaptureUntilDTMF(context.Background(), &captured)
+	if digit != "#" || err != nil {
+		t.Errorf("got %q, %v; want #", digit, err)
+	}
+	if captured.String() != string(audio) {
+		t.Errorf("captured %d bytes, want %d", len(captured.String()), len(audio))
+	}
+	if want := "WAIT FOR DIGIT 1000\nWAIT FOR DIGIT 1000\n"; out.String() != want {
+		t.Errorf("sent %q, want %q", out.String(), want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// the capture goroutine of the last session may still be reading its stream
+	stream, closer = silentReader("")
+	defer closer.Close() // nolint: errcheck
+	a = NewWithStreams(strings.NewReader("agi_uniqueid: 1\n\n"), &bytes.Buffer{}, []io.Reader{stream})
+	if _, err := a.CaptureUntilDTMF(ctx, &bytes.Buffer{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+
+	a = New(strings.NewReader("agi_uniqueid: 1\n\n"), &bytes.Buffer{})
+	if _, err := a.CaptureUntilDTMF(context.Background(), &bytes.Buffer{}); err == nil {
+		t.Error("no error without an EAGI stream")
+	}
+}
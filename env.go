@@ -0,0 +1,143 @@
+package agi
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// env returns the given initial variable, treating the "unknown" placeholder
+// sent by Asterisk for missing values as empty.
+func (a *AGI) env(key string) string {
+	v, _ := a.Variable(key)
+	if v == "unknown" {
+		return ""
+	}
+	return v
+}
+
+// DNID returns the dialed number (`agi_dnid`), or an empty string if unknown.
+func (a *AGI) DNID() string {
+	return a.env("agi_dnid")
+}
+
+// RDNIS returns the redirecting number (`agi_rdnis`), or an empty string if unknown.
+func (a *AGI) RDNIS() string {
+	return a.env("agi_rdnis")
+}
+
+// ChannelType returns the technology of the channel (`agi_type`), such as
+// "SIP", "PJSIP", "IAX2" or "DAHDI".
+func (a *AGI) ChannelType() string {
+	return a.env("agi_type")
+}
+
+// IsSIP reports whether the channel is a SIP channel (chan_sip or chan_pjsip).
+func (a *AGI) IsSIP() bool {
+	switch a.ChannelType() {
+	case "SIP", "PJSIP":
+		return true
+	}
+	return false
+}
+
+// DefaultSIPHeaderPrefixes are the variable name prefixes SIPHeaders looks
+// for unless others are set WithSIPHeaderPrefixes
+var DefaultSIPHeaderPrefixes = []string{"agi_sip_header_", "SIPHEADER", "PJSIP_HEADER"}
+
+// SIPHeaders returns the SIP headers the dialplan passed in the initial
+// variables, as variables named after a header prefix and the header name,
+// such as `agi_sip_header_X-Account`.  The prefixes are matched without
+// regard to case and the map is keyed by header name.
+func (a *AGI) SIPHeaders() map[string]string {
+	prefixes := a.sipHeaderPrefixes
+	if prefixes == nil {
+		prefixes = DefaultSIPHeaderPrefixes
+	}
+
+	a.varMu.RLock()
+	defer a.varMu.RUnlock()
+
+	headers := make(map[string]string)
+	for k, v := range a.Variables {
+		for _, p := range prefixes {
+			if len(k) > len(p) && strings.EqualFold(k[:len(p)], p) {
+				headers[strings.TrimLeft(k[len(p):], "_")] = v
+				break
+			}
+		}
+	}
+	return headers
+}
+
+// Environment holds the agi_ variables Asterisk sends when the session starts
+type Environment struct {
+	Request      string
+	Channel      string
+	Language     string
+	Type         string
+	UniqueID     string
+	Version      string
+	CallerID     string
+	CallerIDName string
+	CallingPres  int
+	CallingANI2  int
+	CallingTON   int
+	CallingTNS   int
+	DNID         string
+	RDNIS        string
+	Context      string
+	Extension    string
+	Priority     int
+	Enhanced     bool
+	AccountCode  string
+	ThreadID     string
+}
+
+// Env returns the initial variables as an Environment.  Missing or malformed
+// values are left as zero values.
+func (a *AGI) Env() Environment {
+	atoi := func(key string) int {
+		n, _ := strconv.Atoi(a.env(key))
+		return n
+	}
+	return Environment{
+		Request:      a.env("agi_request"),
+		Channel:      a.env("agi_channel"),
+		Language:     a.env("agi_language"),
+		Type:         a.env("agi_type"),
+		UniqueID:     a.env("agi_uniqueid"),
+		Version:      a.env("agi_version"),
+		CallerID:     a.env("agi_callerid"),
+		CallerIDName: a.env("agi_calleridname"),
+		CallingPres:  atoi("agi_callingpres"),
+		CallingANI2:  atoi("agi_callingani2"),
+		CallingTON:   atoi("agi_callington"),
+		CallingTNS:   atoi("agi_callingtns"),
+		DNID:         a.env("agi_dnid"),
+		RDNIS:        a.env("agi_rdnis"),
+		Context:      a.env("agi_context"),
+		Extension:    a.env("agi_extension"),
+		Priority:     atoi("agi_priority"),
+		Enhanced:     a.env("agi_enhanced") == "1.0" || a.env("agi_enhanced") == "1",
+		AccountCode:  a.env("agi_accountcode"),
+		ThreadID:     a.env("agi_threadid"),
+	}
+}
+
+// EnvValidated is like Env, but returns an error if the handshake lacked the
+// variables every session needs (`agi_channel` and `agi_uniqueid`).
+func (a *AGI) EnvValidated() (Environment, error) {
+	env := a.Env()
+	var missing []string
+	if env.Channel == "" {
+		missing = append(missing, "agi_channel")
+	}
+	if env.UniqueID == "" {
+		missing = append(missing, "agi_uniqueid")
+	}
+	if len(missing) > 0 {
+		return env, errors.New("missing variables: " + strings.Join(missing, ", "))
+	}
+	return env, nil
+}
@@ -0,0 +1,109 @@
+package agi
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDNIDAndRDNIS(t *testing.T) {
+	tests := []struct {
+		handshake   string
+		dnid, rdnis string
+	}{
+		{"agi_dnid: 5551234\nagi_rdnis: 5550000\n\n", "5551234", "5550000"},
+		{"agi_dnid: unknown\nagi_rdnis: unknown\n\n", "", ""},
+		{"agi_uniqueid: 1\n\n", "", ""},
+	}
+	for _, tt := range tests {
+		a := New(strings.NewReader(tt.handshake), &bytes.Buffer{})
+		if a.DNID() != tt.dnid || a.RDNIS() != tt.rdnis {
+			t.Errorf("%q: got %q, %q; want %q, %q", tt.handshake, a.DNID(), a.RDNIS(), tt.dnid, tt.rdnis)
+		}
+	}
+}
+
+func TestChannelType(t *testing.T) {
+	tests := []struct {
+		kind string
+		sip  bool
+	}{
+		{"SIP", true},
+		{"PJSIP", true},
+		{"IAX2", false},
+		{"DAHDI", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		a := New(strings.NewReader("agi_type: "+tt.kind+"\n\n"), &bytes.Buffer{})
+		if a.ChannelType() != tt.kind || a.IsSIP() != tt.sip {
+			t.Errorf("%q: got %q, %v; want %v", tt.kind, a.ChannelType(), a.IsSIP(), tt.sip)
+		}
+	}
+}
+
+func TestSIPHeaders(t *testing.T) {
+	handshake := "agi_sip_header_X-Account: 42\nSIPHEADER_X_TENANT: acme\nagi_callerid: 100\nX-Custom-Foo: bar\n\n"
+	tests := []struct {
+		name string
+		opts []Option
+		want map[string]string
+	}{
+		{name: "default prefixes", want: map[string]string{"X-Account": "42", "X_TENANT": "acme"}},
+		{name: "custom prefixes", opts: []Option{WithSIPHeaderPrefixes("x-custom-")}, want: map[string]string{"Foo": "bar"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(strings.NewReader(handshake), &bytes.Buffer{}, tt.opts...)
+			got := a.SIPHeaders()
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("%s: got %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestEnvValidated(t *testing.T) {
+	tests := []struct {
+		name      string
+		handshake string
+		want      Environment
+		err       string
+	}{
+		{
+			name: "complete",
+			handshake: "agi_channel: PJSIP/100-00000001\nagi_uniqueid: 1700000000.1\nagi_callerid: 100\n" +
+				"agi_priority: 3\nagi_callingpres: bogus\nagi_enhanced: 1.0\n\n",
+			want: Environment{Channel: "PJSIP/100-00000001", UniqueID: "1700000000.1", CallerID: "100", Priority: 3, Enhanced: true},
+		},
+		{
+			name:      "no channel",
+			handshake: "agi_uniqueid: 1700000000.1\n\n",
+			want:      Environment{UniqueID: "1700000000.1"},
+			err:       "missing variables: agi_channel",
+		},
+		{
+			name:      "empty",
+			handshake: "\n",
+			err:       "missing variables: agi_channel, agi_uniqueid",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(strings.NewReader(tt.handshake), &bytes.Buffer{})
+			env, err := a.EnvValidated()
+			if env != tt.want {
+				t.Errorf("got %+v, want %+v", env, tt.want)
+			}
+			if got := fmt.Sprint(err); (tt.err == "" && err != nil) || (tt.err != "" && got != tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
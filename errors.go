@@ -0,0 +1,89 @@
+package agi
+
+import (
+	"strings"
+	"sync"
+)
+
+// CommandError is an error returned by a command, along with its verb
+type CommandError struct {
+	// Verb is the AGI command which failed, such as "STREAM FILE"
+	Verb string
+
+	// Err is the error the command returned
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	return e.Verb + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error the command returned
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCollector accumulates the errors of the commands of a session
+type ErrorCollector struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+// add records the error of the given command line, if any
+func (c *ErrorCollector) add(cmdString string, err error) {
+	if err == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs = append(c.errs, &CommandError{Verb: commandVerb(cmdString), Err: err})
+}
+
+// Errors returns the collected errors, as *CommandError values, in order
+func (c *ErrorCollector) Errors() []error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]error(nil), c.errs...)
+}
+
+// Errors returns the errors collected since the session started, or nil if
+// the session was not created WithErrorCollector.
+func (a *AGI) Errors() []error {
+	if a.collector == nil {
+		return nil
+	}
+	return a.collector.Errors()
+}
+
+// commandVerbs are the AGI commands of more than one word
+var commandVerbs = []string{
+	"ASYNCAGI BREAK", "CHANNEL STATUS", "CONTROL STREAM FILE",
+	"DATABASE DEL", "DATABASE DELTREE", "DATABASE GET", "DATABASE PUT",
+	"GET DATA", "GET FULL VARIABLE", "GET OPTION", "GET VARIABLE",
+	"RECEIVE CHAR", "RECEIVE TEXT", "RECORD FILE",
+	"SAY ALPHA", "SAY DATE", "SAY DATETIME", "SAY DIGITS", "SAY NUMBER", "SAY PHONETIC", "SAY TIME",
+	"SEND IMAGE", "SEND TEXT",
+	"SET AUTOHANGUP", "SET CALLERID", "SET CONTEXT", "SET EXTENSION", "SET MUSIC", "SET PRIORITY", "SET VARIABLE",
+	"SPEECH ACTIVATE GRAMMAR", "SPEECH CREATE", "SPEECH DEACTIVATE GRAMMAR", "SPEECH DESTROY",
+	"SPEECH LOAD GRAMMAR", "SPEECH RECOGNIZE", "SPEECH SET", "SPEECH UNLOAD GRAMMAR",
+	"STREAM FILE", "TDD MODE", "WAIT FOR DIGIT",
+}
+
+// commandVerb returns the AGI command of a command line, such as
+// "SET VARIABLE" or "EXEC", without its arguments.  Unknown commands are
+// taken to be a single word.
+func commandVerb(line string) string {
+	verb := ""
+	for _, v := range commandVerbs {
+		if len(v) > len(verb) && (line == v || strings.HasPrefix(line, v+" ")) {
+			verb = v
+		}
+	}
+	if verb != "" {
+		return verb
+	}
+	if words := strings.Fields(line); len(words) > 0 {
+		return words[0]
+	}
+	return ""
+}
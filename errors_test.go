@@ -0,0 +1,60 @@
+package agi
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCommandVerb(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"ANSWER", "ANSWER"},
+		{"SET VARIABLE X 1", "SET VARIABLE"},
+		{"GET FULL VARIABLE \"${EPOCH}\"", "GET FULL VARIABLE"},
+		{"SPEECH ACTIVATE GRAMMAR YES", "SPEECH ACTIVATE GRAMMAR"},
+		{"SET EXTENSION s", "SET EXTENSION"},
+		{"SAY DIGITS 12 \"\"", "SAY DIGITS"},
+		{"EXEC Set \"A=b\"", "EXEC"},
+		{"custom command", "custom"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := commandVerb(tt.line); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestWithErrorCollector(t *testing.T) {
+	script := "agi_uniqueid: 1\n\n200 result=1\n510 Invalid or unknown command\n200 result=1 (x)\n"
+	a := New(strings.NewReader(script), &bytes.Buffer{}, WithErrorCollector())
+
+	a.Answer()                       // nolint: errcheck
+	a.Command(0, "BOGUS", "1")       // nolint: errcheck
+	a.Get("X")                       // nolint: errcheck
+	a.Set("X\nHANGUP", "1")          // nolint: errcheck
+	a.Command(0, "STREAM FILE", "a") // nolint: errcheck
+
+	errs := a.Errors()
+	verbs := []string{"BOGUS", "SET VARIABLE", "STREAM FILE"}
+	if len(errs) != len(verbs) {
+		t.Fatalf("got errors %v, want %d", errs, len(verbs))
+	}
+	for i, err := range errs {
+		var cerr *CommandError
+		if !errors.As(err, &cerr) || cerr.Verb != verbs[i] {
+			t.Errorf("error %d: got %v, want one of %s", i, err, verbs[i])
+		}
+	}
+	if !errors.Is(errs[1], ErrLineBreak) {
+		t.Errorf("got %v, want it to wrap ErrLineBreak", errs[1])
+	}
+
+	if New(strings.NewReader("\n"), &bytes.Buffer{}).Errors() != nil {
+		t.Error("errors collected without WithErrorCollector")
+	}
+}
@@ -0,0 +1,263 @@
+package agi
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OnHangup registers fn to be run once, when Asterisk signals that the
+// channel hung up (the `HANGUP` line sent to AGI scripts).  The signal is
+// noticed while a command is waiting for its response; fn runs after that
+// command returns, from the goroutine which issued it.
+func (a *AGI) OnHangup(fn func()) {
+	a.hangupMu.Lock()
+	defer a.hangupMu.Unlock()
+	a.hangupHandlers = append(a.hangupHandlers, fn)
+}
+
+// OnHangupExec schedules the given dialplan application to be run with Exec
+// when the channel hangs up, like an `h` extension would.  Asterisk keeps
+// the AGI connection usable only briefly after the hangup, so the
+// application must be quick, e.g. setting a CDR field or logging.
+func (a *AGI) OnHangupExec(app string, args ...string) error {
+	if app == "" {
+		return errors.New("no application given")
+	}
+	cmd := []string{app}
+	if len(args) > 0 {
+		cmd = append(cmd, quoteArg(a.appArgs(args...)))
+	}
+	a.OnHangup(func() {
+		a.Exec(a.timeouts.Hangup, cmd...) // nolint: errcheck
+	})
+	return nil
+}
+
+// markHangup records that Asterisk signalled the hangup of the channel
+func (a *AGI) markHangup() {
+	a.hangupMu.Lock()
+	defer a.hangupMu.Unlock()
+	a.hungup = true
+	a.closeDoneLocked()
+}
+
+// runHangupHandlers runs the hangup handlers, once the hangup has been signalled
+func (a *AGI) runHangupHandlers() {
+	a.hangupMu.Lock()
+	if !a.hungup || a.hangupHandlers == nil {
+		a.hangupMu.Unlock()
+		return
+	}
+	handlers := a.hangupHandlers
+	a.hangupHandlers = nil
+	a.hangupMu.Unlock()
+
+	for _, fn := range handlers {
+		fn()
+	}
+}
+
+// hangupCauses are the descriptions of the Q.850 cause codes Asterisk reports
+// in HANGUPCAUSE
+var hangupCauses = map[int]string{
+	0:   "Unspecified",
+	1:   "Unallocated (unassigned) number",
+	2:   "No route to specified transit network",
+	3:   "No route to destination",
+	4:   "Send special information tone",
+	5:   "Misdialled trunk prefix",
+	6:   "Channel unacceptable",
+	7:   "Call awarded and being delivered in an established channel",
+	8:   "Preemption",
+	9:   "Preemption - circuit reserved for reuse",
+	14:  "Number ported but not found here",
+	16:  "Normal Clearing",
+	17:  "User Busy",
+	18:  "No user responding",
+	19:  "No answer from user (user alerted)",
+	20:  "Subscriber absent",
+	21:  "Call rejected",
+	22:  "Number changed",
+	23:  "Redirected to new destination",
+	25:  "Exchange routing error",
+	26:  "Non-selected user clearing",
+	27:  "Destination out of order",
+	28:  "Invalid number format (address incomplete)",
+	29:  "Facility rejected",
+	30:  "Response to STATUS ENQUIRY",
+	31:  "Normal, unspecified",
+	34:  "No circuit/channel available",
+	35:  "Call queued",
+	38:  "Network out of order",
+	39:  "Permanent frame mode connection out of service",
+	40:  "Permanent frame mode connection operational",
+	41:  "Temporary failure",
+	42:  "Switching equipment congestion",
+	43:  "Access information discarded",
+	44:  "Requested circuit/channel not available",
+	46:  "Precedence call blocked",
+	47:  "Resource unavailable, unspecified",
+	49:  "Quality of service not available",
+	50:  "Requested facility not subscribed",
+	52:  "Outgoing calls barred",
+	53:  "Outgoing calls barred within CUG",
+	54:  "Incoming calls barred",
+	55:  "Incoming calls barred within CUG",
+	57:  "Bearer capability not authorized",
+	58:  "Bearer capability not presently available",
+	62:  "Inconsistency in designated outgoing access information and subscriber class",
+	63:  "Service or option not available, unspecified",
+	65:  "Bearer capability not implemented",
+	66:  "Channel type not implemented",
+	69:  "Requested facility not implemented",
+	70:  "Only restricted digital information bearer capability is available",
+	79:  "Service or option not implemented, unspecified",
+	81:  "Invalid call reference value",
+	82:  "Identified channel does not exist",
+	83:  "A suspended call exists, but this call identity does not",
+	84:  "Call identity in use",
+	85:  "No call suspended",
+	86:  "Call having the requested call identity has been cleared",
+	87:  "User not member of CUG",
+	88:  "Incompatible destination",
+	90:  "Non-existent CUG",
+	91:  "Invalid transit network selection",
+	95:  "Invalid message, unspecified",
+	96:  "Mandatory information element is missing",
+	97:  "Message type non-existent or not implemented",
+	98:  "Message not compatible with call state or message type non-existent or not implemented",
+	99:  "Information element non-existent or not implemented",
+	100: "Invalid information element contents",
+	101: "Message not compatible with call state",
+	102: "Recovery on timer expiry",
+	103: "Parameter non-existent or not implemented, passed on",
+	110: "Message with unrecognized parameter discarded",
+	111: "Protocol error, unspecified",
+	127: "Interworking, unspecified",
+}
+
+// CauseText returns the description of the given Q.850 cause code, or
+// "Unknown cause <code>" if it is not a standard one.
+func CauseText(code int) string {
+	if text, ok := hangupCauses[code]; ok {
+		return text
+	}
+	return "Unknown cause " + strconv.Itoa(code)
+}
+
+// HangupCauseText returns the description of the Q.850 cause the channel
+// hung up with (the `HANGUPCAUSE` variable), e.g. "User Busy" for 17.
+func (a *AGI) HangupCauseText() (string, error) {
+	val, err := a.Get("HANGUPCAUSE")
+	if err != nil {
+		return "", err
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil {
+		return "", errors.New("invalid hangup cause: " + val)
+	}
+	return CauseText(code), nil
+}
+
+// isHungup reports whether Asterisk signalled the hangup of the channel
+func (a *AGI) isHungup() bool {
+	a.hangupMu.Lock()
+	defer a.hangupMu.Unlock()
+	return a.hungup
+}
+
+// doneC returns a channel closed when the channel hangs up or the session
+// is closed, which stops the background work tied to the session
+func (a *AGI) doneC() <-chan struct{} {
+	a.hangupMu.Lock()
+	defer a.hangupMu.Unlock()
+	if a.done == nil {
+		a.done = make(chan struct{})
+	}
+	return a.done
+}
+
+// closeDone closes the done channel, if not already closed
+func (a *AGI) closeDone() {
+	a.hangupMu.Lock()
+	defer a.hangupMu.Unlock()
+	a.closeDoneLocked()
+}
+
+func (a *AGI) closeDoneLocked() {
+	if a.done == nil {
+		a.done = make(chan struct{})
+	}
+	select {
+	case <-a.done:
+	default:
+		close(a.done)
+	}
+}
+
+// resetHangup forgets the hangup of the previous session, stopping the
+// background work tied to it
+func (a *AGI) resetHangup() {
+	a.hangupMu.Lock()
+	defer a.hangupMu.Unlock()
+	a.closeDoneLocked()
+	a.hungup = false
+	a.hangupHandlers = nil
+	a.done = nil
+}
+
+// SetAutoHangup makes Asterisk hang up the channel after the given duration.
+// A zero duration cancels the automatic hangup.
+func (a *AGI) SetAutoHangup(after time.Duration) error {
+	if after < 0 {
+		return errors.New("negative auto hangup delay")
+	}
+	secs := "0"
+	if after > 0 {
+		// zero would disable the hangup; round sub-second delays up
+		secs = strconv.Itoa(int((after + time.Second - 1) / time.Second))
+	}
+	return a.Command(a.timeouts.Hangup, "SET AUTOHANGUP", secs).Err()
+}
+
+// LimitCall limits the call to the given total duration, after which
+// Asterisk hangs up the channel, and plays warnSound when warnBefore is left.
+// The warning is played from a background goroutine, once the command in
+// progress at that time completes; it is abandoned if the channel hangs up
+// or the session is closed first.
+func (a *AGI) LimitCall(total, warnBefore time.Duration, warnSound string) error {
+	if total <= 0 {
+		return errors.New("call limit must be positive")
+	}
+	if err := a.SetAutoHangup(total); err != nil {
+		return err
+	}
+	if warnSound == "" || warnBefore <= 0 || warnBefore >= total {
+		return nil
+	}
+
+	done := a.doneC()
+	go func() {
+		select {
+		case <-a.clock.After(total - warnBefore):
+		case <-done:
+			return
+		}
+		// the timer may have fired as the session ended
+		select {
+		case <-done:
+		default:
+			a.StreamFile(warnSound, "", 0) // nolint: errcheck
+		}
+	}()
+	return nil
+}
+
+// Alive reports whether the channel is still up, as far as the session
+// knows: it turns false once Asterisk signals the hangup or refuses a
+// command on the dead channel (status 511), without sending any command.
+func (a *AGI) Alive() bool {
+	return !a.isHungup()
+}
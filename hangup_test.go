@@ -0,0 +1,188 @@
+package agi
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer safe for the concurrent writes of
+// background work
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSetAutoHangup(t *testing.T) {
+	tests := []struct {
+		after time.Duration
+		sent  string
+		err   bool
+	}{
+		{after: time.Minute, sent: "SET AUTOHANGUP 60\n"},
+		{after: 1500 * time.Millisecond, sent: "SET AUTOHANGUP 2\n"},
+		{after: time.Millisecond, sent: "SET AUTOHANGUP 1\n"},
+		{after: 0, sent: "SET AUTOHANGUP 0\n"},
+		{after: -time.Second, err: true},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=0\n"), &out)
+		if err := a.SetAutoHangup(tt.after); tt.err != (err != nil) {
+			t.Errorf("%v: got %v", tt.after, err)
+		}
+		if out.String() != tt.sent {
+			t.Errorf("%v: sent %q, want %q", tt.after, out.String(), tt.sent)
+		}
+	}
+}
+
+func TestLimitCall(t *testing.T) {
+	// every command gets the same response, whichever goroutine sends it
+	script := "agi_uniqueid: 1\n\n" + strings.Repeat("200 result=6 endpos=0\n", 10)
+	var out lockedBuffer
+	a := New(strings.NewReader(script), &out, WithAutoAnswer(), WithLanguage("fr"))
+
+	if err := a.LimitCall(2*time.Second, 1990*time.Millisecond, "warning"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.SayDigits("1", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(out.String(), "STREAM FILE warning") {
+		if time.Now().After(deadline) {
+			t.Fatalf("warning not played:\n%s", out.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !strings.HasPrefix(out.String(), "SET AUTOHANGUP 2\n") {
+		t.Errorf("auto hangup not scheduled first:\n%s", out.String())
+	}
+}
+
+func TestLimitCallStopsOnReset(t *testing.T) {
+	var out lockedBuffer
+	a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=0\n"), &out)
+	if err := a.LimitCall(time.Second, 950*time.Millisecond, "warning"); err != nil {
+		t.Fatal(err)
+	}
+	a.Reset(strings.NewReader("agi_uniqueid: 2\n\n"), &out)
+
+	time.Sleep(100 * time.Millisecond)
+	if strings.Contains(out.String(), "warning") {
+		t.Errorf("warning played on the next session:\n%s", out.String())
+	}
+}
+
+func TestAlive(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		alive    bool
+	}{
+		{name: "up", response: "200 result=1\n", alive: true},
+		{name: "failed", response: "200 result=-1\n", alive: true},
+		{name: "hangup signal", response: "HANGUP\n200 result=1\n"},
+		{name: "dead channel", response: "511 Command Not Permitted on a dead channel or intercept routine\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response), &bytes.Buffer{})
+			if !a.Alive() {
+				t.Fatal("not alive before any command")
+			}
+			a.Verbose("hello", 1) // nolint: errcheck
+			if a.Alive() != tt.alive {
+				t.Errorf("got alive %v, want %v", a.Alive(), tt.alive)
+			}
+		})
+	}
+}
+
+func TestOnHangup(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		ran    bool
+		sent   string
+	}{
+		{
+			name:   "signalled",
+			script: "HANGUP\n200 result=1\n200 result=0\n",
+			ran:    true,
+			sent:   "ANSWER\nEXEC Set \"CDR(disposition)=hangup\"\n",
+		},
+		{
+			name:   "not signalled",
+			script: "200 result=1\n",
+			sent:   "ANSWER\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			runs := 0
+			a.OnHangup(func() { runs++ })
+			if err := a.OnHangupExec("Set", "CDR(disposition)=hangup"); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.OnHangupExec(""); err == nil {
+				t.Error("no error without an application")
+			}
+
+			if err := a.Answer(); err != nil {
+				t.Fatal(err)
+			}
+			a.Verbose("again", 1) // nolint: errcheck
+			if (runs == 1) != tt.ran || runs > 1 {
+				t.Errorf("handler ran %d times", runs)
+			}
+			if got, _, _ := strings.Cut(out.String(), "VERBOSE"); got != tt.sent {
+				t.Errorf("sent %q, want %q", got, tt.sent)
+			}
+		})
+	}
+}
+
+func TestHangupCauseText(t *testing.T) {
+	tests := []struct {
+		response string
+		want     string
+		err      bool
+	}{
+		{response: "200 result=1 (16)", want: "Normal Clearing"},
+		{response: "200 result=1 (17)", want: "User Busy"},
+		{response: "200 result=1 (34)", want: "No circuit/channel available"},
+		{response: "200 result=1 (999)", want: "Unknown cause 999"},
+		{response: "200 result=1 (busy)", err: true},
+		{response: "200 result=0", err: true},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &out)
+		got, err := a.HangupCauseText()
+		if got != tt.want || tt.err != (err != nil) {
+			t.Errorf("%q: got %q, %v; want %q", tt.response, got, err, tt.want)
+		}
+		if want := "GET VARIABLE HANGUPCAUSE\n"; out.String() != want {
+			t.Errorf("%q: sent %q, want %q", tt.response, out.String(), want)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package agi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrRetriesExhausted indicates the caller did not provide a valid input
+// within the allowed number of attempts
+var ErrRetriesExhausted = errors.New("retries exhausted")
+
+// Menu maps the digits of a DTMF menu to the handlers run when they are
+// pressed.  Each key is a single digit: 0-9, `*` or `#`.
+type Menu map[string]func(*AGI) error
+
+// Run plays the menu prompt, which may be interrupted by any digit of the
+// menu, and waits at most timeout for a digit after it.  The handler of the
+// digit pressed is then run and its error returned.  If no digit, or a digit
+// not in the menu, is pressed, the prompt is played again, up to retries
+// more times, after which ErrRetriesExhausted is returned.
+func (m Menu) Run(a *AGI, prompt string, timeout time.Duration, retries int) error {
+	return m.RunContext(context.Background(), a, prompt, timeout, retries)
+}
+
+// RunContext runs the menu like Run, within the deadline of the context: the
+// prompt and the wait for a digit are bounded by the time left, and the
+// context error is returned once it is done, however many retries remain.
+func (m Menu) RunContext(ctx context.Context, a *AGI, prompt string, timeout time.Duration, retries int) error {
+	for k := range m {
+		if len(k) != 1 {
+			return fmt.Errorf("menu key %q is not a single digit", k)
+		}
+	}
+	keys := m.keys()
+	if err := validateDTMFSet(keys); err != nil {
+		return err
+	}
+	for attempt := 0; attempt <= retries; attempt++ {
+		// the prompt too must end within the deadline
+		play, err := a.budget(ctx, a.timeouts.StreamFile)
+		if err != nil {
+			return err
+		}
+		digit, err := a.streamFileWithin(play, prompt, keys, 0).Digit()
+		if err == ErrReadTimeout && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil && digit == "" {
+			var wait time.Duration
+			if wait, err = a.budget(ctx, timeout); err == nil {
+				digit, err = a.WaitForDigit(wait)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if handler, ok := m[digit]; ok {
+			return handler(a)
+		}
+	}
+	return ErrRetriesExhausted
+}
+
+// keys returns the digits of the menu, as an escape digit set
+func (m Menu) keys() string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "")
+}
+
+// GetPhoneNumber plays the prompt and collects a phone number of minLen to
+// maxLen digits, ending on `#` or after timeout.  The `*` and `#` keys are
+// not part of the number and are stripped.  A number of invalid length
+// prompts the caller again, up to retries more times, after which
+// ErrRetriesExhausted is returned.
+func (a *AGI) GetPhoneNumber(prompt string, minLen, maxLen int, timeout time.Duration, retries int) (string, error) {
+	return a.GetPhoneNumberContext(context.Background(), prompt, minLen, maxLen, timeout, retries)
+}
+
+// GetPhoneNumberContext collects a phone number like GetPhoneNumber, within
+// the deadline of the context: the wait for digits is shortened to the time
+// left, and the context error is returned once it is done, however many
+// retries remain.
+func (a *AGI) GetPhoneNumberContext(ctx context.Context, prompt string, minLen, maxLen int, timeout time.Duration, retries int) (string, error) {
+	for attempt := 0; attempt <= retries; attempt++ {
+		wait, err := a.budget(ctx, timeout)
+		if err != nil {
+			return "", err
+		}
+		digits, err := a.GetData(prompt, wait, maxLen)
+		if err != nil {
+			return "", err
+		}
+		number := strings.NewReplacer("*", "", "#", "").Replace(digits)
+		if len(number) >= minLen && len(number) <= maxLen {
+			return number, nil
+		}
+	}
+	return "", ErrRetriesExhausted
+}
+
+// budget returns timeout, shortened to the time left before the deadline of
+// the context, or the context error if it is done.
+func (a *AGI) budget(ctx context.Context, timeout time.Duration) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		left := deadline.Sub(a.clock.Now())
+		if left <= 0 {
+			return 0, context.DeadlineExceeded
+		}
+		if timeout <= 0 || left < timeout {
+			timeout = left
+		}
+		// Asterisk takes a zero timeout as its default timeout
+		if timeout < time.Millisecond {
+			timeout = time.Millisecond
+		}
+	}
+	return timeout, nil
+}
+
+var (
+	// e164Regex matches a phone number in E.164 form
+	e164Regex = regexp.MustCompile(`^\+[1-9]\d{6,14}$`)
+
+	// countryCodeRegex matches a country calling code, such as "1" or "+44"
+	countryCodeRegex = regexp.MustCompile(`^\+?[1-9]\d{0,2}$`)
+)
+
+// GetE164 plays the prompt and collects a phone number, ending on `#` or
+// after timeout, which it returns in E.164 form (e.g. "+442071234567").
+// Numbers dialed with the international prefix "00" are taken as is; others
+// are national numbers of defaultCountry, the country calling code (e.g.
+// "44"), from which a leading trunk prefix "0" is dropped.  An invalid number
+// prompts the caller again, up to retries more times, after which
+// ErrRetriesExhausted is returned.
+func (a *AGI) GetE164(prompt string, defaultCountry string, timeout time.Duration, retries int) (string, error) {
+	if defaultCountry != "" && !countryCodeRegex.MatchString(defaultCountry) {
+		return "", errors.New("invalid country code: " + defaultCountry)
+	}
+	country := strings.TrimPrefix(defaultCountry, "+")
+
+	for attempt := 0; attempt <= retries; attempt++ {
+		// the longest number is 15 digits, after the "00" prefix
+		digits, err := a.GetData(prompt, timeout, 17)
+		if err != nil {
+			return "", err
+		}
+		if number, ok := toE164(digits, country); ok {
+			return number, nil
+		}
+	}
+	return "", ErrRetriesExhausted
+}
+
+// toE164 normalizes the dialed digits to E.164 form, with the given country
+// code for national numbers
+func toE164(digits, country string) (string, bool) {
+	digits = strings.NewReplacer("*", "", "#", "").Replace(digits)
+	var number string
+	switch {
+	case strings.HasPrefix(digits, "00"):
+		number = "+" + digits[2:]
+	case country != "":
+		number = "+" + country + strings.TrimPrefix(digits, "0")
+	default:
+		return "", false
+	}
+	return number, e164Regex.MatchString(number)
+}
+
+// listMenuPage is the number of items ListMenu announces at a time, on the
+// digits 1 to 9
+const listMenuPage = 9
+
+// ListItem is an item of a ListMenu: the sound file describing it and the
+// value returned when it is chosen
+type ListItem struct {
+	Sound string
+	Value string
+}
+
+// ListMenu announces a list of items as "press 1 for <item>, press 2 for
+// <item>, ..." and returns the value of the item chosen.  Lists of more than
+// nine items are announced nine at a time, the caller pressing `*` for the
+// next page, which is introduced by "press star" and MoreSound, if set.
+type ListMenu struct {
+	Items     []ListItem
+	MoreSound string
+}
+
+// Run announces the items of the menu and waits at most timeout for a digit
+// after each page.  An invalid digit, or no digit in time, announces the
+// page again, up to retries more times, after which ErrRetriesExhausted is
+// returned.
+func (m ListMenu) Run(a *AGI, timeout time.Duration, retries int) (string, error) {
+	if len(m.Items) == 0 {
+		return "", errors.New("no item in menu")
+	}
+	pages := (len(m.Items) + listMenuPage - 1) / listMenuPage
+
+	page := 0
+	for attempt := 0; attempt <= retries; {
+		start := page * listMenuPage
+		end := start + listMenuPage
+		if end > len(m.Items) {
+			end = len(m.Items)
+		}
+
+		keys := "123456789"[:end-start]
+		var items []SayItem
+		for i, item := range m.Items[start:end] {
+			items = append(items,
+				SayItem{Kind: SayItemFile, Value: "press"},
+				SayItem{Kind: SayItemNumber, Value: strconv.Itoa(i + 1)},
+				SayItem{Kind: SayItemFile, Value: "for"},
+				SayItem{Kind: SayItemFile, Value: item.Sound},
+			)
+		}
+		if pages > 1 {
+			keys += "*"
+			items = append(items,
+				SayItem{Kind: SayItemFile, Value: "press"},
+				SayItem{Kind: SayItemDigits, Value: "*"},
+			)
+			if m.MoreSound != "" {
+				items = append(items,
+					SayItem{Kind: SayItemFile, Value: "for"},
+					SayItem{Kind: SayItemFile, Value: m.MoreSound},
+				)
+			}
+		}
+
+		digit, _, err := a.SaySequence(items, keys)
+		if err == nil && digit == "" {
+			digit, err = a.WaitForDigit(timeout)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if digit == "*" && pages > 1 {
+			page = (page + 1) % pages
+			continue
+		}
+		if digit != "" && strings.Contains(keys, digit) {
+			return m.Items[start+int(digit[0]-'1')].Value, nil
+		}
+		attempt++
+	}
+	return "", ErrRetriesExhausted
+}
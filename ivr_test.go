@@ -0,0 +1,297 @@
+package agi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMenu(t *testing.T) {
+	const (
+		prompt = "STREAM FILE main-menu 12 0"
+		wait   = "WAIT FOR DIGIT 3000"
+	)
+	errSales := errors.New("sales")
+	tests := []struct {
+		name   string
+		script string
+		sent   []string
+		err    error
+	}{
+		{
+			name:   "during the prompt",
+			script: "200 result=49 endpos=100\n",
+			sent:   []string{prompt},
+		},
+		{
+			name:   "after the prompt",
+			script: "200 result=0 endpos=800\n200 result=50\n",
+			sent:   []string{prompt, wait},
+			err:    errSales,
+		},
+		{
+			name:   "retried",
+			script: "200 result=0 endpos=800\n200 result=0\n200 result=57 endpos=100\n",
+			sent:   []string{prompt, wait, prompt},
+			err:    ErrRetriesExhausted,
+		},
+		{
+			name:   "wrong digit then valid",
+			script: "200 result=0 endpos=800\n200 result=57\n200 result=50 endpos=100\n",
+			sent:   []string{prompt, wait, prompt},
+			err:    errSales,
+		},
+		{
+			name:   "hangup",
+			script: "200 result=-1 endpos=0\n",
+			sent:   []string{prompt},
+			err:    ErrHangup,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			menu := Menu{
+				"1": func(*AGI) error { return nil },
+				"2": func(*AGI) error { return errSales },
+			}
+			if err := menu.Run(a, "main-menu", 3*time.Second, 1); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestMenuInvalidKeys(t *testing.T) {
+	noop := func(*AGI) error { return nil }
+	for _, menu := range []Menu{
+		{"12": noop},
+		{"": noop},
+		{"x": noop},
+		{"1": noop, "\"": noop},
+	} {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=0\n"), &out)
+		if err := menu.Run(a, "main-menu", time.Second, 0); err == nil {
+			t.Errorf("%v: no error", menu.keys())
+		}
+		if out.Len() != 0 {
+			t.Errorf("%v: sent %q", menu.keys(), out.String())
+		}
+	}
+}
+
+func TestGetPhoneNumber(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   string
+		sends  int
+		err    error
+	}{
+		{name: "valid", script: "200 result=5551234\n", want: "5551234", sends: 1},
+		{name: "terminated", script: "200 result=5551234#\n", want: "5551234", sends: 1},
+		{name: "stars stripped", script: "200 result=*555*1234\n", want: "5551234", sends: 1},
+		{name: "too short then valid", script: "200 result=55 (timeout)\n200 result=5551234\n", want: "5551234", sends: 2},
+		{name: "exhausted", script: "200 result=55\n200 result=\n", sends: 2, err: ErrRetriesExhausted},
+		{name: "hangup", script: "200 result=-1\n", sends: 1, err: ErrHangup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			got, err := a.GetPhoneNumber("enter-number", 7, 10, 5*time.Second, 1)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("got %q, %v; want %q, %v", got, err, tt.want, tt.err)
+			}
+			if want := strings.Repeat("GET DATA enter-number 5000 10\n", tt.sends); out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	// contexts expire in real time, from which the fake clock starts
+	start := time.Now()
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		script   string
+		sent     []string
+		err      error
+	}{
+		{
+			name:     "prompt and wait bounded",
+			deadline: 2 * time.Second,
+			script:   "200 result=0 endpos=0\n200 result=49\n",
+			sent:     []string{"STREAM FILE menu 1 0", "WAIT FOR DIGIT 2000"},
+		},
+		{
+			name:     "wait not extended",
+			deadline: time.Minute,
+			script:   "200 result=0 endpos=0\n200 result=49\n",
+			sent:     []string{"STREAM FILE menu 1 0", "WAIT FOR DIGIT 3000"},
+		},
+		{name: "expired", err: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out, WithClock(&fakeClock{now: start}))
+			ctx, cancel := context.WithDeadline(context.Background(), start.Add(tt.deadline))
+			defer cancel()
+
+			err := Menu{"1": func(*AGI) error { return nil }}.RunContext(ctx, a, "menu", 3*time.Second, 2)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			want := ""
+			if len(tt.sent) > 0 {
+				want = strings.Join(tt.sent, "\n") + "\n"
+			}
+			if out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestGetPhoneNumberContext(t *testing.T) {
+	start := time.Now()
+	var out bytes.Buffer
+	a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=55\n"), &out, WithClock(&fakeClock{now: start, step: 2 * time.Second}))
+	ctx, cancel := context.WithDeadline(context.Background(), start.Add(2*time.Second))
+	defer cancel()
+
+	// the first attempt gets the 2s left, the retry none
+	if _, err := a.GetPhoneNumberContext(ctx, "enter-number", 7, 10, 5*time.Second, 3); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	if want := "GET DATA enter-number 2000 10\n"; out.String() != want {
+		t.Errorf("sent %q, want %q", out.String(), want)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := a.GetPhoneNumberContext(ctx, "enter-number", 7, 10, 5*time.Second, 3); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestGetE164(t *testing.T) {
+	tests := []struct {
+		name    string
+		country string
+		script  string
+		want    string
+		sends   int
+		err     error
+	}{
+		{name: "national", country: "44", script: "200 result=02071234567\n", want: "+442071234567", sends: 1},
+		{name: "plus country", country: "+1", script: "200 result=2125550100\n", want: "+12125550100", sends: 1},
+		{name: "international", country: "44", script: "200 result=0033123456789\n", want: "+33123456789", sends: 1},
+		{name: "retried", country: "44", script: "200 result=123\n200 result=02071234567\n", want: "+442071234567", sends: 2},
+		{name: "no country", script: "200 result=2071234567\n200 result=2071234567\n", sends: 2, err: ErrRetriesExhausted},
+		{name: "timeout", country: "44", script: "200 result= (timeout)\n200 result= (timeout)\n", sends: 2, err: ErrRetriesExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			got, err := a.GetE164("enter-number", tt.country, 5*time.Second, 1)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("got %q, %v; want %q, %v", got, err, tt.want, tt.err)
+			}
+			if want := strings.Repeat("GET DATA enter-number 5000 17\n", tt.sends); out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+
+	var out bytes.Buffer
+	a := New(strings.NewReader("agi_uniqueid: 1\n\n"), &out)
+	if _, err := a.GetE164("enter-number", "4x", 5*time.Second, 1); err == nil {
+		t.Error("no error for an invalid country code")
+	}
+	if out.Len() != 0 {
+		t.Errorf("sent %q", out.String())
+	}
+}
+
+func TestListMenu(t *testing.T) {
+	const played = "200 result=0 endpos=100\n"
+	small := ListMenu{Items: []ListItem{{"apples", "a"}, {"pears", "p"}}}
+	announce := []string{
+		"STREAM FILE press 12 0", "SAY NUMBER 1 12", "STREAM FILE for 12 0", "STREAM FILE apples 12 0",
+		"STREAM FILE press 12 0", "SAY NUMBER 2 12", "STREAM FILE for 12 0", "STREAM FILE pears 12 0",
+	}
+
+	var paged ListMenu
+	for i := 1; i <= 10; i++ {
+		paged.Items = append(paged.Items, ListItem{"item-" + strconv.Itoa(i), strconv.Itoa(i)})
+	}
+
+	tests := []struct {
+		name   string
+		menu   ListMenu
+		script string
+		sent   []string
+		want   string
+		err    error
+	}{
+		{
+			name:   "chosen after the list",
+			menu:   small,
+			script: strings.Repeat(played, 8) + "200 result=50\n",
+			sent:   append(announce, "WAIT FOR DIGIT 5000"),
+			want:   "p",
+		},
+		{
+			name:   "chosen during the list",
+			menu:   small,
+			script: played + "200 result=49\n",
+			sent:   announce[:2],
+			want:   "a",
+		},
+		{
+			name:   "invalid",
+			menu:   small,
+			script: strings.Repeat(played, 8) + "200 result=57\n",
+			sent:   append(announce, "WAIT FOR DIGIT 5000"),
+			err:    ErrRetriesExhausted,
+		},
+		{
+			name:   "next page",
+			menu:   paged,
+			script: "200 result=42 endpos=100\n" + played + "200 result=49\n",
+			sent:   []string{"STREAM FILE press 123456789* 0", "STREAM FILE press 1* 0", "SAY NUMBER 1 1*"},
+			want:   "10",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			got, err := tt.menu.Run(a, 5*time.Second, 0)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("got %q, %v; want %q, %v", got, err, tt.want, tt.err)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+
+	if _, err := (ListMenu{}).Run(New(strings.NewReader("\n"), &bytes.Buffer{}), time.Second, 0); err == nil {
+		t.Error("no error for an empty menu")
+	}
+}
@@ -0,0 +1,332 @@
+package agi
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Option configures an AGI session at construction time.
+type Option func(*AGI)
+
+// WithLanguage sets the channel language (`CHANNEL(language)`) once, before
+// the first Say* command of the session, so that every subsequent Say* call
+// uses the sound files of that language.
+func WithLanguage(lang string) Option {
+	return func(a *AGI) {
+		a.language = lang
+	}
+}
+
+// WithDebounce makes WaitForDigits discard a digit identical to the previous
+// one when it is received within window, which collapses the double reports
+// of a single keypress seen on noisy lines.  It does not apply to GetData,
+// whose digits are collected by Asterisk without timing information.
+func WithDebounce(window time.Duration) Option {
+	return func(a *AGI) {
+		a.debounce = window
+	}
+}
+
+// Redialer establishes a new connection to replace one which failed.
+type Redialer func() (net.Conn, error)
+
+// WithRedialer makes Command re-establish the connection with redialer, once,
+// when writing a command fails, and replay the command on the new
+// connection.  Without it, a failed write is returned as an error.
+func WithRedialer(redialer Redialer) Option {
+	return func(a *AGI) {
+		a.redialer = redialer
+	}
+}
+
+// WithEchoSuppression makes Command discard a received line which repeats
+// the command just sent, as some AGI-over-serial gateways echo commands back
+// before the response.
+func WithEchoSuppression() Option {
+	return func(a *AGI) {
+		a.echoSuppression = true
+	}
+}
+
+// CommandFilter validates or rewrites a command line before it is sent.
+// Returning an error aborts the command.
+type CommandFilter func(line string) (string, error)
+
+// WithCommandFilter passes every command line through filter before it is
+// sent, for instance to enforce an allowlist of commands or to sanitize
+// values originating from the caller.
+func WithCommandFilter(filter CommandFilter) Option {
+	return func(a *AGI) {
+		a.commandFilter = filter
+	}
+}
+
+// WithLegacyResponses makes Command accept the numeric-only replies some
+// older Asterisk releases send for a few commands, such as "200 1", which
+// lack the `result=` prefix.  A reply without a result gets a result of 0.
+func WithLegacyResponses() Option {
+	return func(a *AGI) {
+		a.legacyResponses = true
+	}
+}
+
+// WithErrorCollector makes the session collect the errors of all its
+// commands, available through Errors, so that a handler running many
+// commands may check them once at the end.
+func WithErrorCollector() Option {
+	return func(a *AGI) {
+		a.collector = &ErrorCollector{}
+	}
+}
+
+// WithLineTerminator sets the terminator written after each command line,
+// "\n" by default, for transports which require "\r\n".  Lines received
+// may end with either terminator regardless.
+func WithLineTerminator(term string) Option {
+	return func(a *AGI) {
+		a.lineTerminator = term
+	}
+}
+
+// WithSIPHeaderPrefixes sets the prefixes of the initial variables which
+// SIPHeaders returns, instead of DefaultSIPHeaderPrefixes.
+func WithSIPHeaderPrefixes(prefixes ...string) Option {
+	return func(a *AGI) {
+		a.sipHeaderPrefixes = prefixes
+	}
+}
+
+// Timeouts holds the response timeouts used by the basic commands.  A zero
+// field keeps the corresponding default from DefaultTimeouts.
+type Timeouts struct {
+	// Answer bounds ANSWER.
+	Answer time.Duration
+
+	// Status bounds CHANNEL STATUS.
+	Status time.Duration
+
+	// Variable bounds GET VARIABLE and SET VARIABLE.
+	Variable time.Duration
+
+	// Hangup bounds HANGUP.
+	Hangup time.Duration
+
+	// StreamFile bounds STREAM FILE.
+	StreamFile time.Duration
+}
+
+// DefaultTimeouts are the timeouts used unless overridden WithTimeouts.
+var DefaultTimeouts = Timeouts{
+	Answer:     30 * time.Second,
+	Status:     5 * time.Second,
+	Variable:   5 * time.Second,
+	Hangup:     1 * time.Second,
+	StreamFile: 60 * time.Second,
+}
+
+// WithTimeouts overrides the timeouts of the basic commands.  Zero fields of
+// t keep their default values.
+func WithTimeouts(t Timeouts) Option {
+	return func(a *AGI) {
+		a.timeouts = t.withDefaults()
+	}
+}
+
+// withDefaults fills the zero fields of t from DefaultTimeouts.
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Answer == 0 {
+		t.Answer = DefaultTimeouts.Answer
+	}
+	if t.Status == 0 {
+		t.Status = DefaultTimeouts.Status
+	}
+	if t.Variable == 0 {
+		t.Variable = DefaultTimeouts.Variable
+	}
+	if t.Hangup == 0 {
+		t.Hangup = DefaultTimeouts.Hangup
+	}
+	if t.StreamFile == 0 {
+		t.StreamFile = DefaultTimeouts.StreamFile
+	}
+	return t
+}
+
+// ApplyTimeoutsFromEnv overrides the timeouts with those given in the initial
+// variables `agi_timeout_answer`, `agi_timeout_status`,
+// `agi_timeout_variable`, `agi_timeout_hangup` and `agi_timeout_streamfile`,
+// letting the dialplan tune them per call.  Values are durations such as
+// "2s" or "1500ms", or plain numbers of milliseconds; missing, malformed and
+// non-positive values are ignored.
+func (a *AGI) ApplyTimeoutsFromEnv() {
+	for key, field := range map[string]*time.Duration{
+		"agi_timeout_answer":     &a.timeouts.Answer,
+		"agi_timeout_status":     &a.timeouts.Status,
+		"agi_timeout_variable":   &a.timeouts.Variable,
+		"agi_timeout_hangup":     &a.timeouts.Hangup,
+		"agi_timeout_streamfile": &a.timeouts.StreamFile,
+	} {
+		v := a.env(key)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			ms, aerr := strconv.Atoi(v)
+			if aerr != nil {
+				continue
+			}
+			d = time.Duration(ms) * time.Millisecond
+		}
+		if d > 0 {
+			*field = d
+		}
+	}
+}
+
+// Clock is a source of time, replaceable to test timeouts deterministically
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the system clock
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// WithClock sets the time source used for command timeouts, digit
+// debouncing, deadline budgets, state polling and the LimitCall warning.
+// Network write deadlines always use the system clock.
+func WithClock(c Clock) Option {
+	return func(a *AGI) {
+		if c != nil {
+			a.clock = c
+		}
+	}
+}
+
+// WithLocalVerbose copies each message sent with Verbose or Verbosef to the
+// given writer, such as the process log, prefixed with the session ID.
+func WithLocalVerbose(w io.Writer) Option {
+	return func(a *AGI) {
+		a.localVerbose = w
+	}
+}
+
+// DefaultSampleRate is the sample rate StreamFileAt assumes unless another is
+// set WithSampleRate
+const DefaultSampleRate = 8000
+
+// WithSampleRate sets the sample rate, in Hz, of the sound files played, used
+// to convert the offsets of StreamFileAt into samples; e.g. 16000 for
+// wideband (sln16, g722) files.
+func WithSampleRate(rate int) Option {
+	return func(a *AGI) {
+		if rate > 0 {
+			a.sampleRate = rate
+		}
+	}
+}
+
+// WithDigitFeedback plays the given tone, a custom tone list in the
+// indications.conf syntax of PlayTone such as "1400/80", after each digit
+// WaitForDigits gathers, to confirm it to the caller.  The tone plays in the
+// background while the next digit is awaited, so it is made not to repeat
+// (as if each part were prefixed with `!`) and it is stopped once
+// WaitForDigits returns.  Named tones, which repeat, and invalid tone lists
+// are ignored.
+func WithDigitFeedback(tone string) Option {
+	return func(a *AGI) {
+		parts := strings.Split(tone, ",")
+		for i, p := range parts {
+			parts[i] = "!" + strings.TrimPrefix(p, "!")
+		}
+		if tone = strings.Join(parts, ","); toneRegex.MatchString(tone) {
+			a.digitFeedback = tone
+		}
+	}
+}
+
+// WithAutoResync makes a command whose response cannot be parsed Resync the
+// protocol, skipping the garbage up to the next response line, which is then
+// taken as the response to the command.
+func WithAutoResync() Option {
+	return func(a *AGI) {
+		a.autoResync = true
+	}
+}
+
+// WithUnquotedValues makes responses with a fully quoted value, such as
+// `200 result=1 ("John Doe")`, report the value without the quotes (`John Doe`)
+// rather than as sent.
+func WithUnquotedValues() Option {
+	return func(a *AGI) {
+		a.unquoteValues = true
+	}
+}
+
+// WithAutoAnswer makes the first command playing or recording audio
+// (StreamFile, Record, GetData, Say*, ...) answer the channel first if it is
+// not up, so that audio is never played to an unanswered channel.
+func WithAutoAnswer() Option {
+	return func(a *AGI) {
+		a.autoAnswer = true
+	}
+}
+
+// ensureAnswered answers the channel, if needed, when the session was created
+// WithAutoAnswer.
+func (a *AGI) ensureAnswered() error {
+	if !a.autoAnswer {
+		return nil
+	}
+	a.stateMu.Lock()
+	answered := a.answered
+	a.stateMu.Unlock()
+	if answered {
+		return nil
+	}
+	return a.AnswerIfNeeded()
+}
+
+// setAnswered records that the channel was answered
+func (a *AGI) setAnswered() {
+	a.stateMu.Lock()
+	defer a.stateMu.Unlock()
+	a.answered = true
+}
+
+// beforeSay prepares the channel for a Say* command
+func (a *AGI) beforeSay() error {
+	if err := a.ensureAnswered(); err != nil {
+		return err
+	}
+	return a.applyLanguage()
+}
+
+// applyLanguage sets the configured channel language if it has not yet been
+// applied to this session.
+func (a *AGI) applyLanguage() error {
+	if a.language == "" {
+		return nil
+	}
+	a.stateMu.Lock()
+	set := a.languageSet
+	a.stateMu.Unlock()
+	if set {
+		return nil
+	}
+
+	if err := a.Set("CHANNEL(language)", a.language); err != nil {
+		return err
+	}
+	a.stateMu.Lock()
+	a.languageSet = true
+	a.stateMu.Unlock()
+	return nil
+}
@@ -0,0 +1,446 @@
+package agi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// silentReader returns a reader which sends the given handshake, then blocks
+// until the returned writer is closed
+func silentReader(handshake string) (io.Reader, io.Closer) {
+	pr, pw := io.Pipe()
+	return io.MultiReader(strings.NewReader(handshake), pr), pw
+}
+
+// waitTimer waits for a command to wait on a timer of clock
+func waitTimer(t *testing.T, clock *fakeClock) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for clock.pending() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no timer started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWithTimeouts(t *testing.T) {
+	timeouts := Timeouts{Answer: time.Second, Status: 2 * time.Second, Variable: 3 * time.Second}
+	tests := []struct {
+		name string
+		run  func(a *AGI) error
+		want time.Duration
+	}{
+		{"Answer", func(a *AGI) error { return a.Answer() }, time.Second},
+		{"Status", func(a *AGI) error { _, err := a.Status(); return err }, 2 * time.Second},
+		{"Get", func(a *AGI) error { _, err := a.Get("X"); return err }, 3 * time.Second},
+		{"Hangup", func(a *AGI) error { return a.Hangup() }, DefaultTimeouts.Hangup},
+		{"StreamFile", func(a *AGI) error { _, err := a.StreamFile("hello", "", 0); return err }, DefaultTimeouts.StreamFile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, closer := silentReader("agi_uniqueid: 1\n\n")
+			defer closer.Close() // nolint: errcheck
+			clock := &fakeClock{}
+			a := New(r, &bytes.Buffer{}, WithTimeouts(timeouts), WithClock(clock))
+
+			errC := make(chan error, 1)
+			go func() { errC <- tt.run(a) }()
+			waitTimer(t, clock)
+
+			clock.Advance(tt.want - time.Millisecond)
+			select {
+			case err := <-errC:
+				t.Fatalf("returned before the timeout: %v", err)
+			case <-time.After(10 * time.Millisecond):
+			}
+			clock.Advance(time.Millisecond)
+			if err := <-errC; !errors.Is(err, ErrReadTimeout) {
+				t.Errorf("got %v, want ErrReadTimeout", err)
+			}
+		})
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	r, closer := silentReader("agi_uniqueid: 1\n\n")
+	defer closer.Close() // nolint: errcheck
+	clock := &fakeClock{}
+	a := New(r, &bytes.Buffer{}, WithClock(clock))
+
+	respC := make(chan *Response, 1)
+	go func() { respC <- a.Command(time.Hour, "WAIT FOR DIGIT", "-1") }()
+	waitTimer(t, clock)
+
+	// the hour passes on the fake clock only
+	select {
+	case resp := <-respC:
+		t.Fatalf("returned before the clock advanced: %+v", resp)
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(time.Hour)
+	if resp := <-respC; !errors.Is(resp.Error, ErrReadTimeout) {
+		t.Errorf("got %v, want ErrReadTimeout", resp.Error)
+	}
+
+	a = New(strings.NewReader("agi_uniqueid: 1\n\n"), &bytes.Buffer{}, WithClock(nil))
+	if _, ok := a.clock.(realClock); !ok {
+		t.Errorf("got clock %T, want the system clock", a.clock)
+	}
+}
+
+// deadConn returns the client end of a connection which sends the given
+// handshake, then is closed by the server
+func deadConn(handshake string) net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		server.Write([]byte(handshake)) // nolint: errcheck
+		server.Close()                  // nolint: errcheck
+	}()
+	return client
+}
+
+func TestApplyTimeoutsFromEnv(t *testing.T) {
+	handshake := "agi_uniqueid: 1\n" +
+		"agi_timeout_answer: 2s\n" +
+		"agi_timeout_status: 1500\n" +
+		"agi_timeout_variable: soon\n" +
+		"agi_timeout_hangup: -1s\n" +
+		"agi_timeout_streamfile: 0\n\n"
+	a := New(strings.NewReader(handshake), &bytes.Buffer{}, WithTimeouts(Timeouts{Variable: 4 * time.Second}))
+	a.ApplyTimeoutsFromEnv()
+
+	want := DefaultTimeouts
+	want.Answer = 2 * time.Second
+	want.Status = 1500 * time.Millisecond
+	want.Variable = 4 * time.Second
+	if a.timeouts != want {
+		t.Errorf("got %+v, want %+v", a.timeouts, want)
+	}
+}
+
+func TestWithRedialer(t *testing.T) {
+	tests := []struct {
+		name     string
+		redialer func(received chan<- string) Redialer
+		err      bool
+	}{
+		{
+			name: "replayed",
+			redialer: func(received chan<- string) Redialer {
+				return func() (net.Conn, error) {
+					client, server := net.Pipe()
+					go func() {
+						line, _ := bufio.NewReader(server).ReadString('\n')
+						received <- line
+						server.Write([]byte("200 result=0\n")) // nolint: errcheck
+					}()
+					return client, nil
+				}
+			},
+		},
+		{
+			name: "redial failed",
+			redialer: func(chan<- string) Redialer {
+				return func() (net.Conn, error) { return nil, errors.New("refused") }
+			},
+			err: true,
+		},
+		{name: "no redialer", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan string, 1)
+			var opts []Option
+			if tt.redialer != nil {
+				opts = append(opts, WithRedialer(tt.redialer(received)))
+			}
+			a := NewConn(deadConn("agi_uniqueid: 1\n\n"), opts...)
+			defer a.Close() // nolint: errcheck
+
+			err := a.Answer()
+			if tt.err {
+				if err == nil {
+					t.Error("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line := <-received; line != "ANSWER\n" {
+				t.Errorf("replayed %q", line)
+			}
+		})
+	}
+}
+
+func TestWithEchoSuppression(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		script string
+		value  string
+		err    bool
+	}{
+		{name: "echoed", opts: []Option{WithEchoSuppression()}, script: "GET VARIABLE X\n200 result=1 (ok)\n", value: "ok"},
+		{name: "not echoed", opts: []Option{WithEchoSuppression()}, script: "200 result=1 (ok)\n", value: "ok"},
+		{name: "echo taken as garbage", script: "GET VARIABLE X\n200 result=1 (ok)\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &bytes.Buffer{}, tt.opts...)
+			got, err := a.Get("X")
+			if tt.err {
+				if err == nil {
+					t.Errorf("no error, got %q", got)
+				}
+				return
+			}
+			if err != nil || got != tt.value {
+				t.Errorf("got %q, %v; want %q", got, err, tt.value)
+			}
+		})
+	}
+}
+
+func TestWithCommandFilter(t *testing.T) {
+	filter := func(line string) (string, error) {
+		switch {
+		case strings.HasPrefix(line, "EXEC System"):
+			return "", errors.New("System not allowed")
+		case strings.HasPrefix(line, "VERBOSE"):
+			return strings.ToUpper(line), nil
+		}
+		return line, nil
+	}
+	tests := []struct {
+		cmd  []string
+		sent string
+		err  bool
+	}{
+		{cmd: []string{"ANSWER"}, sent: "ANSWER\n"},
+		{cmd: []string{"VERBOSE", `"hello"`, "1"}, sent: "VERBOSE \"HELLO\" 1\n"},
+		{cmd: []string{"EXEC", "System", "rm"}, err: true},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=1\n"), &out, WithCommandFilter(filter))
+		resp := a.Command(0, tt.cmd...)
+		if tt.err != (resp.Error != nil) {
+			t.Errorf("%v: got error %v", tt.cmd, resp.Error)
+		}
+		if out.String() != tt.sent {
+			t.Errorf("%v: sent %q, want %q", tt.cmd, out.String(), tt.sent)
+		}
+	}
+}
+
+func TestWithLegacyResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		response string
+		result   int
+		err      bool
+	}{
+		{name: "legacy", opts: []Option{WithLegacyResponses()}, response: "200 1", result: 1},
+		{name: "no result", opts: []Option{WithLegacyResponses()}, response: "200", result: 0},
+		{name: "current", opts: []Option{WithLegacyResponses()}, response: "200 result=2", result: 2},
+		{name: "not enabled", response: "200 1", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &bytes.Buffer{}, tt.opts...)
+			resp := a.Command(0, "ANSWER")
+			if tt.err {
+				if resp.Error == nil {
+					t.Errorf("no error for %q", tt.response)
+				}
+				return
+			}
+			if resp.Error != nil || resp.Result != tt.result {
+				t.Errorf("got %+v, want result %d", resp, tt.result)
+			}
+		})
+	}
+}
+
+func TestWithUnquotedValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		response string
+		want     string
+	}{
+		{name: "quoted", opts: []Option{WithUnquotedValues()}, response: `200 result=1 ("John Doe")`, want: "John Doe"},
+		{name: "escaped", opts: []Option{WithUnquotedValues()}, response: `200 result=1 ("say \"hi\"")`, want: `say "hi"`},
+		{name: "partly quoted", opts: []Option{WithUnquotedValues()}, response: `200 result=1 ("John" Doe)`, want: `"John" Doe`},
+		{name: "unquoted", opts: []Option{WithUnquotedValues()}, response: "200 result=1 (John)", want: "John"},
+		{name: "not enabled", response: `200 result=1 ("John Doe")`, want: `"John Doe"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &bytes.Buffer{}, tt.opts...)
+			got, err := a.Get("CALLERID(name)")
+			if err != nil || got != tt.want {
+				t.Errorf("got %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithLineTerminator(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		sent string
+	}{
+		{name: "default", sent: "ANSWER\nHANGUP\n"},
+		{name: "crlf", opts: []Option{WithLineTerminator("\r\n")}, sent: "ANSWER\r\nHANGUP\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			// responses may end with either terminator regardless
+			a := New(strings.NewReader("agi_uniqueid: 1\r\n\r\n200 result=0\r\n200 result=1\n"), &out, tt.opts...)
+			if err := a.Answer(); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Hangup(); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.sent {
+				t.Errorf("sent %q, want %q", out.String(), tt.sent)
+			}
+			if id := a.SessionID(); id != "1" {
+				t.Errorf("got session ID %q", id)
+			}
+		})
+	}
+}
+
+func TestWithAutoAnswer(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		script string
+		sent   []string
+	}{
+		{
+			name:   "ringing",
+			opts:   []Option{WithAutoAnswer()},
+			script: "200 result=4\n200 result=0\n200 result=0 endpos=0\n200 result=0 endpos=0\n",
+			sent:   []string{"CHANNEL STATUS", "ANSWER", `STREAM FILE hello "" 0`, `STREAM FILE hello "" 0`},
+		},
+		{
+			name:   "up",
+			opts:   []Option{WithAutoAnswer()},
+			script: "200 result=6\n200 result=0 endpos=0\n200 result=0 endpos=0\n",
+			sent:   []string{"CHANNEL STATUS", `STREAM FILE hello "" 0`, `STREAM FILE hello "" 0`},
+		},
+		{
+			name:   "disabled",
+			script: "200 result=0 endpos=0\n200 result=0 endpos=0\n",
+			sent:   []string{`STREAM FILE hello "" 0`, `STREAM FILE hello "" 0`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out, tt.opts...)
+			for i := 0; i < 2; i++ {
+				if _, err := a.StreamFile("hello", "", 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestWithLocalVerbose(t *testing.T) {
+	var out, local bytes.Buffer
+	a := New(strings.NewReader("agi_uniqueid: 1700000000.1\n\n200 result=1\n200 result=1\n"), &out, WithLocalVerbose(&local))
+
+	if err := a.Verbose("caller 100", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verbosef("menu %d", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verbose("two\nlines", 1); !errors.Is(err, ErrLineBreak) {
+		t.Errorf("got %v, want ErrLineBreak", err)
+	}
+
+	if want := "[1700000000.1] caller 100\n[1700000000.1] menu 2\n"; local.String() != want {
+		t.Errorf("logged %q, want %q", local.String(), want)
+	}
+	if want := "VERBOSE \"caller 100\" 3\nVERBOSE \"menu 2\" 9\n"; out.String() != want {
+		t.Errorf("sent %q, want %q", out.String(), want)
+	}
+}
+
+func TestWithDigitFeedback(t *testing.T) {
+	const ok = "200 result=0\n"
+	tests := []struct {
+		name   string
+		tone   string
+		script string
+		sent   []string
+		want   string
+	}{
+		{
+			name:   "each digit",
+			tone:   "1400/80",
+			script: "200 result=49\n" + ok + "200 result=50\n" + ok + "200 result=35\n" + ok,
+			sent: []string{
+				"WAIT FOR DIGIT 5000", `EXEC Playtones "!1400/80"`,
+				"WAIT FOR DIGIT 5000", `EXEC Playtones "!1400/80"`,
+				"WAIT FOR DIGIT 5000", "EXEC StopPlaytones",
+			},
+			want: "12",
+		},
+		{
+			name:   "tone list",
+			tone:   "!1400/80,0/40,1400/80",
+			script: "200 result=49\n" + ok + "200 result=0\n" + ok,
+			sent:   []string{"WAIT FOR DIGIT 5000", `EXEC Playtones "!1400/80,!0/40,!1400/80"`, "WAIT FOR DIGIT 5000", "EXEC StopPlaytones"},
+			want:   "1",
+		},
+		{
+			name:   "no digit",
+			tone:   "1400/80",
+			script: "200 result=0\n",
+			sent:   []string{"WAIT FOR DIGIT 5000"},
+		},
+		{
+			name:   "named tone",
+			tone:   "busy",
+			script: "200 result=49\n200 result=0\n",
+			sent:   []string{"WAIT FOR DIGIT 5000", "WAIT FOR DIGIT 5000"},
+			want:   "1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out, WithDigitFeedback(tt.tone))
+			digits, err := a.WaitForDigits(5*time.Second, 4, "#")
+			if err != nil || digits != tt.want {
+				t.Errorf("got %q, %v; want %q", digits, err, tt.want)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package agi
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// queueStatNames are the suffixes of the variables set by the Queue
+// application (QUEUEPOSITION, QUEUESTATUS) and, with `setqueuevar` or
+// `setqueueentryvar` enabled in queues.conf, the queue statistics
+var queueStatNames = []string{
+	"POSITION",
+	"STATUS",
+	"MAX",
+	"STRATEGY",
+	"CALLS",
+	"HOLDTIME",
+	"TALKTIME",
+	"COMPLETED",
+	"ABANDONED",
+	"SRVLEVEL",
+	"SRVLEVELPERF",
+}
+
+// QueueStats returns the queue variables set on the channel, named after the
+// given prefix ("QUEUE" if empty) followed by POSITION, STATUS, MAX,
+// STRATEGY, CALLS, HOLDTIME, TALKTIME, COMPLETED, ABANDONED, SRVLEVEL or
+// SRVLEVELPERF, e.g. `QUEUEHOLDTIME`.  Variables which are not set are left
+// out of the map.
+func (a *AGI) QueueStats(prefix string) (map[string]string, error) {
+	if prefix == "" {
+		prefix = "QUEUE"
+	}
+	stats := make(map[string]string)
+	for _, name := range queueStatNames {
+		val, err := a.GetFull("${" + prefix + name + "}")
+		if err != nil {
+			return nil, err
+		}
+		if val != "" {
+			stats[prefix+name] = val
+		}
+	}
+	return stats, nil
+}
+
+// HoldTime returns how long the caller has been waiting since the epoch time
+// the dialplan stored in the given variable, e.g. with
+// `Set(HOLDSTART=${EPOCH})`, compared with `${EPOCH}` on the Asterisk
+// server.  It returns ErrNotSet if the variable is not set.
+func (a *AGI) HoldTime(startVar string) (time.Duration, error) {
+	val, err := a.Get(startVar)
+	if err != nil {
+		return 0, err
+	}
+	if val == "" {
+		return 0, ErrNotSet
+	}
+	start, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid start time %q in %s", val, startVar)
+	}
+
+	val, err = a.GetFull("${EPOCH}")
+	if err != nil {
+		return 0, err
+	}
+	now, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid epoch %q", val)
+	}
+
+	if now < start {
+		return 0, nil
+	}
+	return time.Duration((now - start) * float64(time.Second)).Round(time.Second), nil
+}
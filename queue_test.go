@@ -0,0 +1,110 @@
+package agi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueStats(t *testing.T) {
+	tests := []struct {
+		prefix string
+		vars   string
+		set    map[string]string
+		want   map[string]string
+	}{
+		{
+			vars: "QUEUE",
+			set:  map[string]string{"POSITION": "3", "STATUS": "TIMEOUT", "HOLDTIME": "42"},
+			want: map[string]string{"QUEUEPOSITION": "3", "QUEUESTATUS": "TIMEOUT", "QUEUEHOLDTIME": "42"},
+		},
+		{
+			prefix: "SALES_",
+			vars:   "SALES_",
+			set:    map[string]string{"CALLS": "7"},
+			want:   map[string]string{"SALES_CALLS": "7"},
+		},
+		{vars: "QUEUE", want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		var script, sent strings.Builder
+		for _, name := range queueStatNames {
+			if val, ok := tt.set[name]; ok {
+				script.WriteString("200 result=1 (" + val + ")\n")
+			} else {
+				script.WriteString("200 result=1 ()\n")
+			}
+			sent.WriteString("GET FULL VARIABLE \"${" + tt.vars + name + "}\"\n")
+		}
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n"+script.String()), &out)
+
+		got, err := a.QueueStats(tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.prefix, got, tt.want)
+		}
+		if out.String() != sent.String() {
+			t.Errorf("%q: sent %q, want %q", tt.prefix, out.String(), sent.String())
+		}
+	}
+
+	a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=1 (3)\n511 Command Not Permitted on a dead channel or intercept routine\n"), &bytes.Buffer{})
+	if _, err := a.QueueStats(""); !errors.Is(err, ErrHangup) {
+		t.Errorf("got %v, want ErrHangup", err)
+	}
+}
+
+func TestHoldTime(t *testing.T) {
+	const epoch = `GET FULL VARIABLE "${EPOCH}"`
+	tests := []struct {
+		name   string
+		script string
+		sent   []string
+		want   time.Duration
+		err    bool
+	}{
+		{
+			name:   "waiting",
+			script: "200 result=1 (1709294400)\n200 result=1 (1709294565)\n",
+			sent:   []string{"GET VARIABLE HOLDSTART", epoch},
+			want:   165 * time.Second,
+		},
+		{
+			name:   "fractional start",
+			script: "200 result=1 (1709294400.6)\n200 result=1 (1709294402)\n",
+			sent:   []string{"GET VARIABLE HOLDSTART", epoch},
+			want:   time.Second,
+		},
+		{
+			name:   "clock skew",
+			script: "200 result=1 (1709294400)\n200 result=1 (1709294399)\n",
+			sent:   []string{"GET VARIABLE HOLDSTART", epoch},
+		},
+		{name: "not set", script: "200 result=0\n", sent: []string{"GET VARIABLE HOLDSTART"}, err: true},
+		{name: "invalid", script: "200 result=1 (noon)\n", sent: []string{"GET VARIABLE HOLDSTART"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			got, err := a.HoldTime("HOLDSTART")
+			if got != tt.want || tt.err != (err != nil) {
+				t.Errorf("got %v, %v; want %v", got, err, tt.want)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+
+	a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=0\n"), &bytes.Buffer{})
+	if _, err := a.HoldTime("HOLDSTART"); !errors.Is(err, ErrNotSet) {
+		t.Errorf("got %v, want ErrNotSet", err)
+	}
+}
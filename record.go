@@ -0,0 +1,217 @@
+package agi
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrRecordWrite indicates Asterisk could not write the recording file, e.g.
+// for lack of disk space or permission
+var ErrRecordWrite = errors.New("failed to write the recording file")
+
+// RecordReason describes why a recording ended
+type RecordReason int
+
+const (
+	// RecordTimeout indicates the maximum recording time was reached
+	RecordTimeout RecordReason = iota
+
+	// RecordDTMF indicates one of the escape digits was pressed
+	RecordDTMF
+
+	// RecordSilence indicates the caller stopped speaking for longer than the allowed silence
+	RecordSilence
+
+	// RecordHangup indicates the channel hung up during the recording
+	RecordHangup
+)
+
+// RecordResult describes a finished recording
+type RecordResult struct {
+	// Reason is the reason the recording ended
+	Reason RecordReason
+
+	// Digit is the escape digit which ended the recording, if Reason is RecordDTMF
+	Digit string
+
+	// EndPos is the length of the recording, in samples
+	EndPos int
+}
+
+// RecordVAD records audio to a file until the caller stops speaking for
+// maxSilence, reporting RecordSilence as the reason when the recording ended
+// that way.  Asterisk reports silence and the maximum recording time alike,
+// so a recording ending before opts.Timeout is taken to have ended on silence.
+// On hangup, the partial result is returned along with ErrHangup.
+func (a *AGI) RecordVAD(name string, opts *RecordOptions, maxSilence time.Duration) (*RecordResult, error) {
+	o := RecordOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	o.Silence = maxSilence
+
+	return a.recordResult(a.record(name, &o), &o)
+}
+
+// RecordFile records audio to a file like Record, and reports how the
+// recording ended.  On hangup, the partial result is returned along with
+// ErrHangup.
+func (a *AGI) RecordFile(name string, opts *RecordOptions) (*RecordResult, error) {
+	if opts == nil {
+		opts = &RecordOptions{}
+	}
+	return a.recordResult(a.record(name, opts), opts)
+}
+
+// recordResult decodes the response to a RECORD FILE command sent with opts.
+// The result is the ASCII code of the escape digit when one ended the
+// recording, 0 when it timed out (or stopped on silence) and -1 when the
+// channel hung up or, flagged `(writefile)`, the file could not be written.
+func (a *AGI) recordResult(resp *Response, opts *RecordOptions) (*RecordResult, error) {
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	res := &RecordResult{}
+	res.EndPos, _ = resp.EndPos()
+
+	switch {
+	case resp.Result < 0 && resp.flag() == "writefile":
+		return nil, ErrRecordWrite
+	case resp.Result < 0:
+		res.Reason = RecordHangup
+		return res, ErrHangup
+	case resp.Result > 0:
+		res.Reason = RecordDTMF
+		res.Digit = string(rune(resp.Result))
+	default:
+		res.Reason = RecordTimeout
+		limit := int(opts.Timeout.Seconds() * float64(a.sampleRate))
+		if opts.Silence > 0 && res.EndPos < limit {
+			res.Reason = RecordSilence
+		}
+	}
+	return res, nil
+}
+
+// reviewTimeout bounds the wait for a choice after the review prompt
+const reviewTimeout = 5 * time.Second
+
+// LeaveVoicemail runs the usual voicemail flow: it plays the greeting (which
+// `#` skips), records the message to the named file after a beep until `#`,
+// silence or the time limit, then lets the caller review it with the
+// standard "vm-review" prompt: 1 (or no choice) accepts the message, 2 plays
+// it back and 3 records it again.  If the caller hangs up while recording,
+// the partial result is returned along with ErrHangup.
+func (a *AGI) LeaveVoicemail(name, greeting string, opts *RecordOptions) (*RecordResult, error) {
+	o := RecordOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	o.Beep = true
+
+	if greeting != "" {
+		if _, err := a.StreamFile(greeting, "#", 0); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		res, err := a.recordResult(a.record(name, &o), &o)
+		if err != nil {
+			return res, err
+		}
+
+		choice, err := a.reviewRecording(name)
+		if err != nil || choice != "3" {
+			return res, err
+		}
+	}
+}
+
+// reviewRecording plays the "vm-review" prompt, playing the named recording
+// back for as long as the caller chooses 2, and returns the final choice.
+func (a *AGI) reviewRecording(name string) (string, error) {
+	for {
+		choice, err := a.StreamFile("vm-review", "123", 0)
+		if err == nil && choice == "" {
+			choice, err = a.WaitForDigit(reviewTimeout)
+		}
+		if err != nil || choice != "2" {
+			return choice, err
+		}
+		if _, err := a.StreamFile(name, "", 0); err != nil {
+			return "", err
+		}
+	}
+}
+
+// RecordOptionsBuilder builds RecordOptions fluently, for example:
+//
+//	opts := agi.NewRecordOptions().Format("gsm").Beep().Silence(3 * time.Second).Build()
+type RecordOptionsBuilder struct {
+	opts RecordOptions
+}
+
+// NewRecordOptions starts building RecordOptions
+func NewRecordOptions() *RecordOptionsBuilder {
+	return &RecordOptionsBuilder{}
+}
+
+// Format sets the format of the audio file to record
+func (b *RecordOptionsBuilder) Format(format string) *RecordOptionsBuilder {
+	b.opts.Format = format
+	return b
+}
+
+// EscapeDigits sets the digits which terminate the recording
+func (b *RecordOptionsBuilder) EscapeDigits(digits string) *RecordOptionsBuilder {
+	b.opts.EscapeDigits = digits
+	return b
+}
+
+// Timeout sets the maximum time to allow for the recording
+func (b *RecordOptionsBuilder) Timeout(timeout time.Duration) *RecordOptionsBuilder {
+	b.opts.Timeout = timeout
+	return b
+}
+
+// Silence sets the maximum amount of silence to allow before ending the recording
+func (b *RecordOptionsBuilder) Silence(silence time.Duration) *RecordOptionsBuilder {
+	b.opts.Silence = silence
+	return b
+}
+
+// Beep plays a beep before starting the recording
+func (b *RecordOptionsBuilder) Beep() *RecordOptionsBuilder {
+	b.opts.Beep = true
+	return b
+}
+
+// Offset sets the number of samples to skip at the beginning of the recording
+func (b *RecordOptionsBuilder) Offset(offset int) *RecordOptionsBuilder {
+	b.opts.Offset = offset
+	return b
+}
+
+// Build returns the RecordOptions built so far
+func (b *RecordOptionsBuilder) Build() *RecordOptions {
+	opts := b.opts
+	return &opts
+}
+
+// RecordName plays the prompt, then the beep sound if one is given, and
+// records the caller speaking their name to the named file, as when setting
+// up a voicemail box.  If the caller hangs up while recording, the partial
+// result is returned along with ErrHangup.
+func (a *AGI) RecordName(name, promptPlay, beep string, opts *RecordOptions) (*RecordResult, error) {
+	for _, sound := range []string{promptPlay, beep} {
+		if sound == "" {
+			continue
+		}
+		if _, err := a.StreamFile(sound, "", 0); err != nil {
+			return nil, err
+		}
+	}
+	return a.RecordFile(name, opts)
+}
@@ -0,0 +1,250 @@
+package agi
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordVAD(t *testing.T) {
+	opts := &RecordOptions{Timeout: 10 * time.Second}
+	tests := []struct {
+		name     string
+		opts     []Option
+		response string
+		want     *RecordResult
+		err      error
+	}{
+		{name: "silence", response: "200 result=0 endpos=24000", want: &RecordResult{Reason: RecordSilence, EndPos: 24000}},
+		{name: "time limit", response: "200 result=0 endpos=80000", want: &RecordResult{Reason: RecordTimeout, EndPos: 80000}},
+		{
+			name:     "wideband silence",
+			opts:     []Option{WithSampleRate(16000)},
+			response: "200 result=0 endpos=80000",
+			want:     &RecordResult{Reason: RecordSilence, EndPos: 80000},
+		},
+		{name: "digit", response: "200 result=35 (dtmf) endpos=4000", want: &RecordResult{Reason: RecordDTMF, Digit: "#", EndPos: 4000}},
+		{name: "hangup", response: "200 result=-1 (hangup) endpos=1600", want: &RecordResult{Reason: RecordHangup, EndPos: 1600}, err: ErrHangup},
+		{name: "write failure", response: "200 result=-1 (writefile)", err: ErrRecordWrite},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &out, tt.opts...)
+			got, err := a.RecordVAD("msg", opts, 3*time.Second)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if want := "RECORD FILE  msg wav # 10000 s=3\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+	if opts.Silence != 0 {
+		t.Error("RecordVAD changed the options of the caller")
+	}
+}
+
+func TestLeaveVoicemail(t *testing.T) {
+	const (
+		greeting = "STREAM FILE greeting # 0"
+		record   = "RECORD FILE  msg wav # 300000 BEEP"
+		review   = "STREAM FILE vm-review 123 0"
+	)
+	tests := []struct {
+		name   string
+		script string
+		sent   []string
+		want   *RecordResult
+		err    error
+	}{
+		{
+			name:   "accepted",
+			script: "200 result=0 endpos=0\n200 result=35 (dtmf) endpos=8000\n200 result=49 endpos=0\n",
+			sent:   []string{greeting, record, review},
+			want:   &RecordResult{Reason: RecordDTMF, Digit: "#", EndPos: 8000},
+		},
+		{
+			name:   "no choice",
+			script: "200 result=35 endpos=0\n200 result=0 endpos=16000\n200 result=0 endpos=0\n200 result=0\n",
+			sent:   []string{greeting, record, review, "WAIT FOR DIGIT 5000"},
+			want:   &RecordResult{Reason: RecordTimeout, EndPos: 16000},
+		},
+		{
+			name: "played back",
+			script: "200 result=0 endpos=0\n200 result=35 endpos=8000\n200 result=50 endpos=0\n" +
+				"200 result=0 endpos=8000\n200 result=0 endpos=0\n200 result=49\n",
+			sent: []string{greeting, record, review, "STREAM FILE msg \"\" 0", review, "WAIT FOR DIGIT 5000"},
+			want: &RecordResult{Reason: RecordDTMF, Digit: "#", EndPos: 8000},
+		},
+		{
+			name: "recorded again",
+			script: "200 result=0 endpos=0\n200 result=35 endpos=8000\n200 result=51 endpos=0\n" +
+				"200 result=35 endpos=4000\n200 result=49 endpos=0\n",
+			sent: []string{greeting, record, review, record, review},
+			want: &RecordResult{Reason: RecordDTMF, Digit: "#", EndPos: 4000},
+		},
+		{
+			name:   "hangup while recording",
+			script: "200 result=0 endpos=0\n200 result=-1 (hangup) endpos=800\n",
+			sent:   []string{greeting, record},
+			want:   &RecordResult{Reason: RecordHangup, EndPos: 800},
+			err:    ErrHangup,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			got, err := a.LeaveVoicemail("msg", "greeting", nil)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+			if got == nil || *got != *tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestRecordFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     *RecordOptions
+		response string
+		sent     string
+		want     *RecordResult
+		err      error
+	}{
+		{
+			name:     "timeout",
+			response: "200 result=0 (timeout) endpos=2400000",
+			sent:     "RECORD FILE  msg wav # 300000",
+			want:     &RecordResult{Reason: RecordTimeout, EndPos: 2400000},
+		},
+		{
+			name:     "short without silence detection",
+			response: "200 result=0 endpos=800",
+			sent:     "RECORD FILE  msg wav # 300000",
+			want:     &RecordResult{Reason: RecordTimeout, EndPos: 800},
+		},
+		{
+			name:     "digit",
+			opts:     &RecordOptions{Format: "gsm", EscapeDigits: "*#", Timeout: time.Minute, Beep: true, Offset: 160},
+			response: "200 result=42 (dtmf) endpos=8000",
+			sent:     "RECORD FILE  msg gsm *# 60000 160 BEEP",
+			want:     &RecordResult{Reason: RecordDTMF, Digit: "*", EndPos: 8000},
+		},
+		{
+			name:     "hangup",
+			response: "200 result=-1 (hangup) endpos=0",
+			sent:     "RECORD FILE  msg wav # 300000",
+			want:     &RecordResult{Reason: RecordHangup},
+			err:      ErrHangup,
+		},
+		{
+			name:     "write failure",
+			response: "200 result=-1 (writefile)",
+			sent:     "RECORD FILE  msg wav # 300000",
+			err:      ErrRecordWrite,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &out)
+			got, err := a.RecordFile("msg", tt.opts)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if out.String() != tt.sent+"\n" {
+				t.Errorf("sent %q, want %q", out.String(), tt.sent+"\n")
+			}
+		})
+	}
+}
+
+func TestRecordOptionsBuilder(t *testing.T) {
+	tests := []struct {
+		name string
+		b    *RecordOptionsBuilder
+		want RecordOptions
+	}{
+		{name: "empty", b: NewRecordOptions()},
+		{
+			name: "all",
+			b: NewRecordOptions().Format("gsm").EscapeDigits("*#").Timeout(time.Minute).
+				Silence(3 * time.Second).Beep().Offset(80),
+			want: RecordOptions{Format: "gsm", EscapeDigits: "*#", Timeout: time.Minute, Silence: 3 * time.Second, Beep: true, Offset: 80},
+		},
+	}
+	for _, tt := range tests {
+		opts := tt.b.Build()
+		if *opts != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *opts, tt.want)
+		}
+		// later changes to the builder do not alter what it built
+		tt.b.Format("ulaw")
+		if *opts != tt.want {
+			t.Errorf("%s: built options changed to %+v", tt.name, *opts)
+		}
+	}
+}
+
+func TestRecordName(t *testing.T) {
+	tests := []struct {
+		name   string
+		prompt string
+		beep   string
+		script string
+		sent   []string
+		want   *RecordResult
+		err    error
+	}{
+		{
+			name: "prompt and beep", prompt: "vm-rec-name", beep: "beep",
+			script: "200 result=0 endpos=0\n200 result=0 endpos=0\n200 result=35 endpos=12000\n",
+			sent:   []string{`STREAM FILE vm-rec-name "" 0`, `STREAM FILE beep "" 0`, "RECORD FILE  name wav # 300000"},
+			want:   &RecordResult{Reason: RecordDTMF, Digit: "#", EndPos: 12000},
+		},
+		{
+			name: "no beep", prompt: "vm-rec-name",
+			script: "200 result=0 endpos=0\n200 result=0 endpos=16000\n",
+			sent:   []string{`STREAM FILE vm-rec-name "" 0`, "RECORD FILE  name wav # 300000"},
+			want:   &RecordResult{Reason: RecordTimeout, EndPos: 16000},
+		},
+		{
+			name: "hangup during the prompt", prompt: "vm-rec-name", beep: "beep",
+			script: "200 result=-1 endpos=0\n",
+			sent:   []string{`STREAM FILE vm-rec-name "" 0`},
+			err:    ErrHangup,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			got, err := a.RecordName("name", tt.prompt, tt.beep, nil)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
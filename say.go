@@ -0,0 +1,266 @@
+package agi
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SayDuration announces a duration in hours, minutes and seconds, such as
+// "1 hours 2 minutes 3 seconds", skipping the zero components.  A zero
+// duration is announced as "0 seconds".  It returns the escape digit pressed
+// by the caller, if any, which stops the announcement.
+func (a *AGI) SayDuration(d time.Duration, escapeDigits string) (string, error) {
+	type part struct {
+		n    int
+		unit string
+	}
+
+	d = d.Round(time.Second)
+	var parts []part
+	for _, p := range []part{
+		{int(d / time.Hour), "hours"},
+		{int(d % time.Hour / time.Minute), "minutes"},
+		{int(d % time.Minute / time.Second), "seconds"},
+	} {
+		if p.n != 0 {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		parts = []part{{0, "seconds"}}
+	}
+
+	for _, p := range parts {
+		digit, err := a.SayNumber(strconv.Itoa(p.n), escapeDigits)
+		if err != nil || digit != "" {
+			return digit, err
+		}
+		digit, err = a.StreamFile(p.unit, escapeDigits, 0)
+		if err != nil || digit != "" {
+			return digit, err
+		}
+	}
+	return "", nil
+}
+
+// SayAlphaSlow plays a character string like SayAlpha, one character at a
+// time with the given pause between characters, which is easier to follow
+// for some callers.  An escape digit pressed while a character is played or
+// during a pause stops the announcement and is returned.
+func (a *AGI) SayAlphaSlow(label, escapeDigits string, pause time.Duration) (string, error) {
+	chars := []rune(label)
+	for i, c := range chars {
+		digit, err := a.SayAlpha(string(c), escapeDigits)
+		if err != nil || digit != "" {
+			return digit, err
+		}
+		if i == len(chars)-1 || pause <= 0 {
+			continue
+		}
+
+		digit, err = a.WaitForDigit(pause)
+		if err != nil {
+			return "", err
+		}
+		if digit != "" && strings.Contains(escapeDigits, digit) {
+			return digit, nil
+		}
+	}
+	return "", nil
+}
+
+// SayKind is the kind of a SayItem
+type SayKind int
+
+const (
+	// SayItemNumber plays Value as a number
+	SayItemNumber SayKind = iota
+
+	// SayItemDigits plays Value digit by digit
+	SayItemDigits
+
+	// SayItemDate plays the date of Time
+	SayItemDate
+
+	// SayItemFile plays the sound file named Value
+	SayItemFile
+
+	// SayItemSilence waits for Pause, listening for escape digits
+	SayItemSilence
+)
+
+// SayItem is a part of an announcement played by SaySequence
+type SayItem struct {
+	Kind  SayKind
+	Value string
+	Time  time.Time
+	Pause time.Duration
+}
+
+// SaySequence plays the given items in order.  An escape digit pressed by the
+// caller stops the announcement; it is returned with the index of the item
+// which was playing.  If the announcement completes, the index is len(items).
+func (a *AGI) SaySequence(items []SayItem, escapeDigits string) (digit string, index int, err error) {
+	if err := validateDTMFSet(escapeDigits); err != nil {
+		return "", 0, err
+	}
+
+	for i, item := range items {
+		switch item.Kind {
+		case SayItemNumber:
+			digit, err = a.SayNumber(item.Value, escapeDigits)
+		case SayItemDigits:
+			digit, err = a.SayDigits(item.Value, escapeDigits)
+		case SayItemDate:
+			digit, err = a.SayDate(item.Time, escapeDigits)
+		case SayItemFile:
+			digit, err = a.StreamFile(item.Value, escapeDigits, 0)
+		case SayItemSilence:
+			if item.Pause <= 0 {
+				continue
+			}
+			digit, err = a.WaitForDigit(item.Pause)
+			if digit != "" && !strings.Contains(escapeDigits, digit) {
+				digit = ""
+			}
+		default:
+			return "", i, fmt.Errorf("unknown say item kind %d", item.Kind)
+		}
+		if err != nil || digit != "" {
+			return digit, i, err
+		}
+	}
+	return "", len(items), nil
+}
+
+// SayOrdinal plays the given number as an ordinal ("first", "twenty-second",
+// ...) from the `digits/h-N` sound files of the channel language, which
+// exist for 1 to 20 and the multiples of ten.  Other numbers are built from
+// a cardinal part followed by an ordinal one.  When the language lacks the
+// ordinal files, or the number is a multiple of one hundred, the number is
+// played as a cardinal.
+func (a *AGI) SayOrdinal(n int, escapeDigits string) (string, error) {
+	rest := n % 100
+	if n <= 0 || rest == 0 {
+		return a.SayNumber(strconv.Itoa(n), escapeDigits)
+	}
+
+	cardinal := n - rest
+	if rest > 20 && rest%10 != 0 {
+		cardinal += rest - rest%10
+		rest %= 10
+	}
+	if cardinal > 0 {
+		digit, err := a.SayNumber(strconv.Itoa(cardinal), escapeDigits)
+		if err != nil || digit != "" {
+			return digit, err
+		}
+	}
+
+	digit, err := a.StreamFile("digits/h-"+strconv.Itoa(rest), escapeDigits, 0)
+	if err != ErrHangup {
+		return digit, err
+	}
+
+	// STREAM FILE fails the same way for a missing file and a hangup
+	if state, serr := a.Status(); serr != nil || state == StateDown {
+		return "", ErrHangup
+	}
+	return a.SayNumber(strconv.Itoa(rest), escapeDigits)
+}
+
+// SayCurrentTime announces the current time, as hours and minutes, in the
+// given time zone.  If loc is nil, the zone is read from the TIMEZONE channel
+// variable, an IANA zone name such as "Europe/Paris" which the dialplan may
+// set per caller; Asterisk's own zone is used when it is unset.
+func (a *AGI) SayCurrentTime(escapeDigits string, loc *time.Location) (string, error) {
+	if err := validateDTMFSet(escapeDigits); err != nil {
+		return "", err
+	}
+
+	var zone string
+	if loc != nil {
+		zone = loc.String()
+	} else {
+		name, err := a.Get("TIMEZONE")
+		if err != nil {
+			return "", err
+		}
+		if name != "" {
+			if _, err := time.LoadLocation(name); err != nil {
+				return "", fmt.Errorf("invalid time zone %q: %v", name, err)
+			}
+			zone = name
+		}
+	}
+
+	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
+	if escapeDigits == "" {
+		escapeDigits = `""`
+	}
+	if err := a.beforeSay(); err != nil {
+		return "", err
+	}
+	if zone == "Local" {
+		zone = ""
+	}
+	args := sayDateTimeArgs(toEpoch(a.clock.Now()), escapeDigits, "IMp", zone)
+	return a.Command(0, append([]string{"SAY DATETIME"}, args...)...).Digit()
+}
+
+const (
+	// otpRepeatKey is the key which repeats the code announced by SpeakOTP
+	otpRepeatKey = "*"
+
+	// otpMaxRepeats bounds the repetitions of SpeakOTP
+	otpMaxRepeats = 3
+
+	// otpRepeatWait is how long SpeakOTP waits for the repeat key
+	otpRepeatWait = 3 * time.Second
+)
+
+// SpeakOTP announces a one-time code digit by digit, keeping any leading
+// zeros.  If repeatSound is set, it is played after the code (e.g. "press
+// star to hear the code again") and the caller may press `*`, during the
+// code or up to 3 seconds after the sound, to hear the code again, up to 3
+// more times.  An escape digit pressed at any point stops the announcement
+// and is returned.
+func (a *AGI) SpeakOTP(code string, repeatSound string, escapeDigits string) (string, error) {
+	if code == "" || strings.Trim(code, "0123456789") != "" {
+		return "", fmt.Errorf("invalid code %q", code)
+	}
+	if err := validateDTMFSet(escapeDigits); err != nil {
+		return "", err
+	}
+	if repeatSound != "" && strings.Contains(escapeDigits, otpRepeatKey) {
+		return "", errors.New("the repeat key * cannot be an escape digit")
+	}
+
+	keys := escapeDigits
+	if repeatSound != "" {
+		keys += otpRepeatKey
+	}
+	for repeat := 0; repeat <= otpMaxRepeats; repeat++ {
+		digit, err := a.SayDigits(code, keys)
+		if err == nil && digit == "" && repeatSound != "" {
+			digit, err = a.StreamFile(repeatSound, keys, 0)
+			if err == nil && digit == "" {
+				digit, err = a.WaitForDigit(otpRepeatWait)
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+		if digit == otpRepeatKey && repeatSound != "" {
+			continue
+		}
+		if digit != "" && strings.Contains(escapeDigits, digit) {
+			return digit, nil
+		}
+		return "", nil
+	}
+	return "", nil
+}
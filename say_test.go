@@ -0,0 +1,388 @@
+package agi
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithLanguage(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		script string
+		sent   string
+		err    error
+	}{
+		{
+			name:   "no language",
+			script: "200 result=0\n200 result=0\n",
+			sent:   "SAY DIGITS 12 \"\"\nSAY NUMBER 3 \"\"\n",
+		},
+		{
+			name:   "set once",
+			opts:   []Option{WithLanguage("fr")},
+			script: "200 result=1\n200 result=0\n200 result=0\n",
+			sent:   "SET VARIABLE CHANNEL(language) fr\nSAY DIGITS 12 \"\"\nSAY NUMBER 3 \"\"\n",
+		},
+		{
+			name:   "set failed",
+			opts:   []Option{WithLanguage("fr")},
+			script: "200 result=0\n",
+			sent:   "SET VARIABLE CHANNEL(language) fr\n",
+			err:    ErrSetFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out, tt.opts...)
+
+			_, err := a.SayDigits("12", "")
+			if err == nil {
+				_, err = a.SayNumber("3", "")
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+			if out.String() != tt.sent {
+				t.Errorf("sent %q, want %q", out.String(), tt.sent)
+			}
+		})
+	}
+}
+
+func TestSayDuration(t *testing.T) {
+	tests := []struct {
+		d      time.Duration
+		script string
+		sent   []string
+		digit  string
+	}{
+		{
+			d:    time.Hour + 2*time.Minute + 3*time.Second,
+			sent: []string{"SAY NUMBER 1", "STREAM FILE hours", "SAY NUMBER 2", "STREAM FILE minutes", "SAY NUMBER 3", "STREAM FILE seconds"},
+		},
+		{d: 5 * time.Minute, sent: []string{"SAY NUMBER 5", "STREAM FILE minutes"}},
+		{d: 90*time.Second + 400*time.Millisecond, sent: []string{"SAY NUMBER 1", "STREAM FILE minutes", "SAY NUMBER 30", "STREAM FILE seconds"}},
+		{d: 0, sent: []string{"SAY NUMBER 0", "STREAM FILE seconds"}},
+		{d: 2 * time.Hour, script: "200 result=0\n200 result=35 endpos=100\n", sent: []string{"SAY NUMBER 2", "STREAM FILE hours"}, digit: "#"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.d.String(), func(t *testing.T) {
+			script := tt.script
+			if script == "" {
+				script = strings.Repeat("200 result=0 endpos=0\n", len(tt.sent))
+			}
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+script), &out)
+			digit, err := a.SayDuration(tt.d, "#")
+			if err != nil || digit != tt.digit {
+				t.Errorf("got %q, %v; want %q", digit, err, tt.digit)
+			}
+			var want string
+			for _, line := range tt.sent {
+				if strings.HasPrefix(line, "SAY") {
+					want += line + " #\n"
+				} else {
+					want += line + " # 0\n"
+				}
+			}
+			if out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestSayAlphaSlow(t *testing.T) {
+	tests := []struct {
+		name   string
+		pause  time.Duration
+		script string
+		sent   []string
+		digit  string
+	}{
+		{
+			name: "paused", pause: 300 * time.Millisecond,
+			script: "200 result=0\n200 result=0\n200 result=0\n200 result=0\n200 result=0\n",
+			sent:   []string{"SAY ALPHA a #", "WAIT FOR DIGIT 300", "SAY ALPHA b #", "WAIT FOR DIGIT 300", "SAY ALPHA c #"},
+		},
+		{
+			name:   "no pause",
+			script: "200 result=0\n200 result=0\n200 result=0\n",
+			sent:   []string{"SAY ALPHA a #", "SAY ALPHA b #", "SAY ALPHA c #"},
+		},
+		{
+			name: "escaped during a letter", pause: 300 * time.Millisecond,
+			script: "200 result=0\n200 result=0\n200 result=35\n",
+			sent:   []string{"SAY ALPHA a #", "WAIT FOR DIGIT 300", "SAY ALPHA b #"},
+			digit:  "#",
+		},
+		{
+			name: "escaped during a pause", pause: 300 * time.Millisecond,
+			script: "200 result=0\n200 result=35\n",
+			sent:   []string{"SAY ALPHA a #", "WAIT FOR DIGIT 300"},
+			digit:  "#",
+		},
+		{
+			name: "other digit ignored", pause: 300 * time.Millisecond,
+			script: "200 result=0\n200 result=49\n200 result=0\n200 result=0\n200 result=0\n",
+			sent:   []string{"SAY ALPHA a #", "WAIT FOR DIGIT 300", "SAY ALPHA b #", "WAIT FOR DIGIT 300", "SAY ALPHA c #"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			digit, err := a.SayAlphaSlow("abc", "#", tt.pause)
+			if err != nil || digit != tt.digit {
+				t.Errorf("got %q, %v; want %q", digit, err, tt.digit)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestSaySequence(t *testing.T) {
+	items := []SayItem{
+		{Kind: SayItemFile, Value: "you-have"},
+		{Kind: SayItemNumber, Value: "3"},
+		{Kind: SayItemSilence, Pause: 500 * time.Millisecond},
+		{Kind: SayItemDigits, Value: "12"},
+		{Kind: SayItemDate, Time: time.Unix(1709294400, 0)},
+	}
+	sent := []string{
+		"STREAM FILE you-have 1 0",
+		"SAY NUMBER 3 1",
+		"WAIT FOR DIGIT 500",
+		"SAY DIGITS 12 1",
+		"SAY DATE 1709294400 1",
+	}
+
+	tests := []struct {
+		name   string
+		script string
+		digit  string
+		index  int
+		err    bool
+	}{
+		{
+			name:   "complete",
+			script: "200 result=0 endpos=100\n200 result=0\n200 result=0\n200 result=0\n200 result=0\n",
+			index:  5,
+		},
+		{
+			name:   "interrupted",
+			script: "200 result=0 endpos=100\n200 result=0\n200 result=0\n200 result=49\n",
+			digit:  "1",
+			index:  3,
+		},
+		{
+			name:   "other digit in pause",
+			script: "200 result=0 endpos=100\n200 result=0\n200 result=50\n200 result=0\n200 result=0\n",
+			index:  5,
+		},
+		{
+			name:   "hangup",
+			script: "200 result=0 endpos=100\n200 result=-1\n",
+			index:  1,
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+
+			digit, index, err := a.SaySequence(items, "1")
+			if digit != tt.digit || index != tt.index || tt.err != (err != nil) {
+				t.Errorf("got %q, %d, %v; want %q, %d", digit, index, err, tt.digit, tt.index)
+			}
+			n := tt.index + 1
+			if n > len(sent) {
+				n = len(sent)
+			}
+			if want := strings.Join(sent[:n], "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+
+	var out bytes.Buffer
+	a := New(strings.NewReader("agi_uniqueid: 1\n\n"), &out)
+	if _, _, err := a.SaySequence([]SayItem{{Kind: SayKind(99)}}, ""); err == nil {
+		t.Error("no error for an unknown kind")
+	}
+	if _, _, err := a.SaySequence(items, "x"); err == nil {
+		t.Error("no error for invalid escape digits")
+	}
+	if out.Len() != 0 {
+		t.Errorf("sent %q", out.String())
+	}
+}
+
+func TestSayOrdinal(t *testing.T) {
+	const ok = "200 result=0 endpos=100\n"
+	tests := []struct {
+		n      int
+		script string
+		sent   []string
+		digit  string
+		err    error
+	}{
+		{n: 3, script: ok, sent: []string{"STREAM FILE digits/h-3 1 0"}},
+		{n: 40, script: ok, sent: []string{"STREAM FILE digits/h-40 1 0"}},
+		{n: 23, script: ok + ok, sent: []string{"SAY NUMBER 20 1", "STREAM FILE digits/h-3 1 0"}},
+		{n: 115, script: ok + ok, sent: []string{"SAY NUMBER 100 1", "STREAM FILE digits/h-15 1 0"}},
+		{n: 142, script: ok + ok, sent: []string{"SAY NUMBER 140 1", "STREAM FILE digits/h-2 1 0"}},
+		{n: 200, script: ok, sent: []string{"SAY NUMBER 200 1"}},
+		{n: 0, script: ok, sent: []string{"SAY NUMBER 0 1"}},
+		{n: 23, script: "200 result=49\n", sent: []string{"SAY NUMBER 20 1"}, digit: "1"},
+		{
+			// no ordinal files in the language
+			n: 3, script: "200 result=-1 endpos=0\n200 result=6\n" + ok,
+			sent: []string{"STREAM FILE digits/h-3 1 0", "CHANNEL STATUS", "SAY NUMBER 3 1"},
+		},
+		{
+			n: 3, script: "200 result=-1 endpos=0\n511 Command Not Permitted on a dead channel or intercept routine\n",
+			sent: []string{"STREAM FILE digits/h-3 1 0", "CHANNEL STATUS"},
+			err:  ErrHangup,
+		},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+		digit, err := a.SayOrdinal(tt.n, "1")
+		if digit != tt.digit || !errors.Is(err, tt.err) {
+			t.Errorf("%d: got %q, %v; want %q, %v", tt.n, digit, err, tt.digit, tt.err)
+		}
+		if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+			t.Errorf("%d: sent %q, want %q", tt.n, out.String(), want)
+		}
+	}
+}
+
+func TestSayDateTime(t *testing.T) {
+	when := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		format string
+		escape string
+		sent   string
+	}{
+		{format: "IMp", sent: `SAY DATETIME 1709294400 "" IMp UTC`},
+		{format: "", escape: "#", sent: `SAY DATETIME 1709294400 # ABdY 'digits/at' IMp UTC`},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_version: 18.20.0\n\n200 result=0\n"), &out)
+		if _, err := a.SayDateTime(when, tt.escape, tt.format); err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.sent + "\n"; out.String() != want {
+			t.Errorf("%q: sent %q, want %q", tt.format, out.String(), want)
+		}
+	}
+}
+
+func TestSayCurrentTime(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		loc    *time.Location
+		script string
+		sent   []string
+		err    bool
+	}{
+		{name: "given zone", loc: paris, script: "200 result=0\n", sent: []string{`SAY DATETIME 1709294400 "" IMp Europe/Paris`}},
+		{name: "local zone", loc: time.Local, script: "200 result=0\n", sent: []string{`SAY DATETIME 1709294400 "" IMp`}},
+		{
+			name: "channel zone", script: "200 result=1 (America/New_York)\n200 result=0\n",
+			sent: []string{"GET VARIABLE TIMEZONE", `SAY DATETIME 1709294400 "" IMp America/New_York`},
+		},
+		{
+			name: "server zone", script: "200 result=0\n200 result=0\n",
+			sent: []string{"GET VARIABLE TIMEZONE", `SAY DATETIME 1709294400 "" IMp`},
+		},
+		{
+			name: "invalid zone", script: "200 result=1 (Mars/Olympus)\n",
+			sent: []string{"GET VARIABLE TIMEZONE"}, err: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_version: 18.20.0\n\n"+tt.script), &out, WithClock(&fakeClock{now: now}))
+			if _, err := a.SayCurrentTime("", tt.loc); tt.err != (err != nil) {
+				t.Errorf("got %v", err)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestSpeakOTP(t *testing.T) {
+	const (
+		ok   = "200 result=0\n"
+		star = "200 result=42\n"
+	)
+	full := []string{"SAY DIGITS 0042 #*", "STREAM FILE repeat-code #* 0", "WAIT FOR DIGIT 3000"}
+	tests := []struct {
+		name   string
+		repeat string
+		script string
+		sent   []string
+		want   string
+	}{
+		{name: "plain", script: ok, sent: []string{"SAY DIGITS 0042 #"}},
+		{name: "no repeat", repeat: "repeat-code", script: ok + ok + ok, sent: full},
+		{
+			name: "repeat after", repeat: "repeat-code", script: ok + ok + star + ok + ok + ok,
+			sent: append(append([]string{}, full...), full...),
+		},
+		{
+			name: "repeat during", repeat: "repeat-code", script: star + ok + ok + ok,
+			sent: append([]string{"SAY DIGITS 0042 #*"}, full...),
+		},
+		{name: "escape", repeat: "repeat-code", script: "200 result=35\n", sent: full[:1], want: "#"},
+		{
+			name: "repeat limit", repeat: "repeat-code", script: strings.Repeat(star, 4),
+			sent: []string{"SAY DIGITS 0042 #*", "SAY DIGITS 0042 #*", "SAY DIGITS 0042 #*", "SAY DIGITS 0042 #*"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			digit, err := a.SpeakOTP("0042", tt.repeat, "#")
+			if err != nil || digit != tt.want {
+				t.Errorf("got %q, %v; want %q", digit, err, tt.want)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+
+	var out bytes.Buffer
+	a := New(strings.NewReader("agi_uniqueid: 1\n\n"), &out)
+	if _, err := a.SpeakOTP("12a4", "", ""); err == nil {
+		t.Error("no error for an invalid code")
+	}
+	if _, err := a.SpeakOTP("1234", "repeat-code", "*#"); err == nil {
+		t.Error("no error for the repeat key as an escape digit")
+	}
+	if out.Len() != 0 {
+		t.Errorf("sent %q", out.String())
+	}
+}
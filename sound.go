@@ -0,0 +1,364 @@
+package agi
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// soundPath returns the server-side path of a sound file, resolving names
+// relative to the Asterisk sounds directory.
+func soundPath(name string) string {
+	if strings.HasPrefix(name, "/") {
+		return name
+	}
+	return path.Join("${ASTDATADIR}/sounds", name)
+}
+
+// soundFormats are the file extensions of the sound formats probed for a
+// name given without one
+var soundFormats = []string{
+	".wav", ".sln", ".sln16", ".ulaw", ".alaw", ".gsm", ".g722", ".g729",
+	".ogg", ".siren7", ".siren14", ".g726", ".ilbc",
+}
+
+// hasSoundFormat reports whether name ends with the extension of a known
+// sound format
+func hasSoundFormat(name string) bool {
+	ext := path.Ext(name)
+	if _, ok := soundByteRates[ext]; ok {
+		return true
+	}
+	for _, f := range soundFormats {
+		if f == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// findSound returns the first name made of name and one of the given
+// extensions which exists on the server, or "" if there is none.  All the
+// names are checked in a single command.
+func (a *AGI) findSound(name string, exts []string) (string, error) {
+	var expr strings.Builder
+	for _, ext := range exts {
+		expr.WriteString("${STAT(e," + soundPath(name+ext) + ")}")
+	}
+	r, err := a.GetFull(expr.String())
+	if err != nil {
+		return "", err
+	}
+	for i, ext := range exts {
+		if i < len(r) && r[i] == '1' {
+			return name + ext, nil
+		}
+	}
+	return "", nil
+}
+
+// FileExists reports whether the given sound file exists.  The check is
+// performed by Asterisk on the server, so it is accurate even for FastAGI
+// scripts running on another host.  Relative names are resolved against the
+// Asterisk sounds directory, and must include any language directory.  As
+// for STREAM FILE, the name may omit the file extension, in which case it
+// exists in any of the known formats (e.g. "custom/welcome" for
+// "custom/welcome.wav" or "custom/welcome.gsm").
+func (a *AGI) FileExists(name string) (bool, error) {
+	if !hasSoundFormat(name) {
+		found, err := a.findSound(name, soundFormats)
+		return found != "", err
+	}
+	r, err := a.GetFull("${STAT(e," + soundPath(name) + ")}")
+	if err != nil {
+		return false, err
+	}
+	return r == "1", nil
+}
+
+// soundByteRates are the number of bytes per second of audio of the sound
+// file formats whose duration can be derived from their size
+var soundByteRates = map[string]int{
+	".wav":   16000, // 8kHz 16-bit mono, after the 44 byte header
+	".sln":   16000,
+	".raw":   16000,
+	".sln16": 32000,
+	".ulaw":  8000,
+	".ul":    8000,
+	".pcm":   8000,
+	".alaw":  8000,
+	".al":    8000,
+	".g722":  8000,
+	".gsm":   1650,
+	".g729":  1000,
+}
+
+// durationFormats are the extensions probed by FileDuration for a name given
+// without one, in the order of soundFormats
+var durationFormats = []string{
+	".wav", ".sln", ".sln16", ".ulaw", ".alaw", ".gsm", ".g722", ".g729",
+}
+
+// FileDuration returns the duration of the given sound file, computed from
+// its size, as reported by Asterisk on the server, and its format, which
+// must be one of the constant bit rate formats Asterisk ships sounds in
+// (wav, sln, sln16, ulaw, alaw, g722, gsm or g729).  As with FileExists, the
+// name may omit the extension: the first of these formats found is used,
+// all the formats of a sound having the same duration.
+func (a *AGI) FileDuration(name string) (time.Duration, error) {
+	if !hasSoundFormat(name) {
+		found, err := a.findSound(name, durationFormats)
+		if err != nil {
+			return 0, err
+		}
+		if found == "" {
+			return 0, fmt.Errorf("no sound file %s in a supported format", name)
+		}
+		name = found
+	}
+
+	ext := path.Ext(name)
+	rate, ok := soundByteRates[ext]
+	if !ok {
+		return 0, fmt.Errorf("unsupported sound format %q", ext)
+	}
+
+	r, err := a.GetFull("${STAT(s," + soundPath(name) + ")}")
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.Atoi(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the size of %s", name)
+	}
+	if ext == ".wav" && size > 44 {
+		size -= 44
+	}
+	return time.Duration(size) * time.Second / time.Duration(rate), nil
+}
+
+// Regex for a sound file extension, such as "wav" or "sln16"
+var formatRegex = regexp.MustCompile(`^[[:alnum:]]+$`)
+
+// SayTTS plays text spoken by an external text-to-speech engine: synth
+// returns the audio and its format, as the file extension Asterisk expects
+// (e.g. "wav" or "sln16"), which is written to a temporary file, played with
+// StreamFile and deleted.  The temporary file is written locally, so
+// Asterisk must run on the same host (or share the temporary directory).
+// It returns the escape digit pressed by the caller, if any.
+func (a *AGI) SayTTS(ctx context.Context, text string, synth func(ctx context.Context, text string) ([]byte, string, error), escapeDigits string) (digit string, err error) {
+	data, format, err := synth(ctx, text)
+	if err != nil {
+		return "", fmt.Errorf("failed to synthesize speech: %w", err)
+	}
+
+	name, err := writeTempSound(data, format)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(name + "." + format) // nolint: errcheck
+
+	return a.StreamFile(name, escapeDigits, 0)
+}
+
+// writeTempSound writes audio of the given format to a temporary file and
+// returns its name, without the extension, as STREAM FILE expects.  The file
+// is made world-readable, since Asterisk usually runs as another user than
+// the script.
+func writeTempSound(data []byte, format string) (string, error) {
+	if !formatRegex.MatchString(format) {
+		return "", fmt.Errorf("invalid sound format %q", format)
+	}
+
+	f, err := os.CreateTemp("", "agi-*."+format)
+	if err != nil {
+		return "", fmt.Errorf("failed to create sound file: %w", err)
+	}
+	// CreateTemp creates the file with mode 0600
+	err = f.Chmod(0644)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name()) // nolint: errcheck
+		return "", fmt.Errorf("failed to write sound file: %w", err)
+	}
+	return strings.TrimSuffix(f.Name(), "."+format), nil
+}
+
+// ResumeFunc resumes a playback interrupted by an escape digit from where it
+// stopped, returning the next escape digit and continuation
+type ResumeFunc func() (digit string, resume ResumeFunc, err error)
+
+// StreamFileResumable plays the given file like StreamFile.  If an escape
+// digit interrupts the playback, it also returns a continuation which plays
+// the rest of the file, from the position reached; resume is nil once the
+// file was played to the end.
+func (a *AGI) StreamFileResumable(name, escapeDigits string) (digit string, resume ResumeFunc, err error) {
+	return a.streamFrom(name, escapeDigits, 0)
+}
+
+func (a *AGI) streamFrom(name, escapeDigits string, offset int) (string, ResumeFunc, error) {
+	resp := a.streamFile(name, escapeDigits, offset)
+	digit, err := resp.Digit()
+	if err != nil || digit == "" {
+		return digit, nil, err
+	}
+	endpos, err := resp.EndPos()
+	if err != nil {
+		return digit, nil, err
+	}
+	return digit, func() (string, ResumeFunc, error) {
+		return a.streamFrom(name, escapeDigits, endpos)
+	}, nil
+}
+
+// StreamFileAt plays the given file like StreamFile, starting at the given
+// time offset.  The offset is converted to samples at the sample rate set
+// WithSampleRate, 8000 Hz by default, which must match the file format
+// Asterisk picks for the channel.
+func (a *AGI) StreamFileAt(name, escapeDigits string, offset time.Duration) (string, error) {
+	if offset < 0 {
+		return "", errors.New("negative offset")
+	}
+	samples := int(offset * time.Duration(a.sampleRate) / time.Second)
+	return a.StreamFile(name, escapeDigits, samples)
+}
+
+const (
+	// streamURLMaxSize bounds the size of the audio downloaded by StreamURL
+	streamURLMaxSize = 10 << 20
+
+	// streamURLTimeout bounds the download of StreamURL
+	streamURLTimeout = 30 * time.Second
+)
+
+// urlSoundFormats maps the audio content types to sound file formats
+var urlSoundFormats = map[string]string{
+	"audio/wav":    "wav",
+	"audio/x-wav":  "wav",
+	"audio/wave":   "wav",
+	"audio/basic":  "ulaw",
+	"audio/pcmu":   "ulaw",
+	"audio/pcma":   "alaw",
+	"audio/gsm":    "gsm",
+	"audio/g722":   "g722",
+	"audio/ogg":    "ogg",
+	"audio/x-gsm":  "gsm",
+	"audio/l16":    "sln",
+	"audio/x-slin": "sln",
+}
+
+// soundCache holds the sound files downloaded by StreamURL during the
+// session, by hash of their URL
+type soundCache struct {
+	mu    sync.Mutex
+	files map[string]cachedSound
+}
+
+type cachedSound struct {
+	name   string
+	format string
+}
+
+// StreamURL plays the audio found at the given HTTP(S) URL: it is downloaded,
+// within the context and at most 30 seconds, to a temporary file, which is
+// then played with StreamFile.  The format is taken from the extension of
+// the URL path, if a known one, or else from the content type.  Downloads
+// are cached for the session and the files deleted by Close or Reset; as with
+// SayTTS, Asterisk must run on the same host.  It returns the escape digit
+// pressed by the caller, if any.
+func (a *AGI) StreamURL(ctx context.Context, url string, escapeDigits string) (string, error) {
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(url)))
+
+	a.sounds.mu.Lock()
+	sound, ok := a.sounds.files[key]
+	a.sounds.mu.Unlock()
+
+	if !ok {
+		var err error
+		if sound, err = downloadSound(ctx, url); err != nil {
+			return "", err
+		}
+		a.sounds.mu.Lock()
+		if cached, ok := a.sounds.files[key]; ok {
+			// a concurrent call downloaded the same URL first
+			os.Remove(sound.name + "." + sound.format) // nolint: errcheck
+			sound = cached
+		} else {
+			if a.sounds.files == nil {
+				a.sounds.files = make(map[string]cachedSound)
+			}
+			a.sounds.files[key] = sound
+		}
+		a.sounds.mu.Unlock()
+	}
+
+	return a.StreamFile(sound.name, escapeDigits, 0)
+}
+
+// downloadSound downloads the audio at the given URL to a temporary file
+func downloadSound(ctx context.Context, url string) (cachedSound, error) {
+	ctx, cancel := context.WithTimeout(ctx, streamURLTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return cachedSound{}, fmt.Errorf("invalid sound URL: %w", err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return cachedSound{}, fmt.Errorf("failed to download sound: %w", err)
+	}
+	defer res.Body.Close() // nolint: errcheck
+
+	if res.StatusCode != http.StatusOK {
+		return cachedSound{}, fmt.Errorf("failed to download sound: %s", res.Status)
+	}
+
+	format := strings.TrimPrefix(path.Ext(req.URL.Path), ".")
+	if _, ok := soundByteRates["."+format]; !ok && format != "ogg" {
+		mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if format = urlSoundFormats[strings.ToLower(mediaType)]; format == "" {
+			return cachedSound{}, fmt.Errorf("unknown sound format for %s", url)
+		}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, streamURLMaxSize+1))
+	if err != nil {
+		return cachedSound{}, fmt.Errorf("failed to download sound: %w", err)
+	}
+	if len(data) > streamURLMaxSize {
+		return cachedSound{}, fmt.Errorf("sound at %s exceeds %d bytes", url, streamURLMaxSize)
+	}
+
+	name, err := writeTempSound(data, format)
+	if err != nil {
+		return cachedSound{}, err
+	}
+	return cachedSound{name, format}, nil
+}
+
+// removeSounds deletes the sound files downloaded by StreamURL
+func (a *AGI) removeSounds() {
+	a.sounds.mu.Lock()
+	defer a.sounds.mu.Unlock()
+	for _, sound := range a.sounds.files {
+		os.Remove(sound.name + "." + sound.format) // nolint: errcheck
+	}
+	a.sounds.files = nil
+}
@@ -0,0 +1,399 @@
+package agi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamURL(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	blob := []byte("\xff\x7f\xff\x7f")
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/page":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>")) // nolint: errcheck
+		case "/huge":
+			w.Header().Set("Content-Type", "audio/basic")
+			w.Write(make([]byte, streamURLMaxSize+1)) // nolint: errcheck
+		default:
+			w.Header().Set("Content-Type", "audio/basic; rate=8000")
+			w.Write(blob) // nolint: errcheck
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		format string
+		err    bool
+	}{
+		{name: "content type", path: "/hello", format: "ulaw"},
+		{name: "extension", path: "/hello.wav", format: "wav"},
+		{name: "not found", path: "/missing", err: true},
+		{name: "not audio", path: "/page", err: true},
+		{name: "too large", path: "/huge", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []string
+			var played []byte
+			w := writerFunc(func(p []byte) (int, error) {
+				line := strings.TrimSuffix(string(p), "\n")
+				sent = append(sent, line)
+				if f := strings.Fields(line); len(f) > 2 {
+					played, _ = os.ReadFile(f[2] + "." + tt.format)
+				}
+				return len(p), nil
+			})
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=0 endpos=4\n200 result=0 endpos=4\n"), w)
+			defer a.Close() // nolint: errcheck
+
+			// the second call plays the cached download
+			for i := 0; i < 2; i++ {
+				_, err := a.StreamURL(context.Background(), srv.URL+tt.path, "")
+				if tt.err != (err != nil) {
+					t.Fatalf("got %v", err)
+				}
+			}
+			mu.Lock()
+			n := hits[tt.path]
+			mu.Unlock()
+			if tt.err {
+				if len(sent) != 0 || n != 2 {
+					t.Errorf("sent %q after %d downloads", sent, n)
+				}
+				return
+			}
+			if n != 1 {
+				t.Errorf("downloaded %d times, want once", n)
+			}
+			if len(sent) != 2 || sent[0] != sent[1] {
+				t.Errorf("sent %q, want the same file twice", sent)
+			}
+			if !bytes.Equal(played, blob) {
+				t.Errorf("played %q, want %q", played, blob)
+			}
+		})
+	}
+}
+
+func TestStreamURLConcurrentMiss(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	// hold both downloads until they are both under way
+	var started sync.WaitGroup
+	started.Add(2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		started.Wait()
+		w.Header().Set("Content-Type", "audio/basic")
+		w.Write([]byte("\xff\xff\xff\xff")) // nolint: errcheck
+	}))
+	defer srv.Close()
+
+	var out lockedBuffer
+	a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=0 endpos=0\n200 result=0 endpos=0\n"), &out)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := a.StreamURL(context.Background(), srv.URL+"/hello", ""); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || lines[0] != lines[1] {
+		t.Fatalf("both calls must play the cached file:\n%s", out.String())
+	}
+	name := strings.Fields(lines[0])[2] + ".ulaw"
+	if files, _ := filepath.Glob(filepath.Join(tmp, "agi-*")); len(files) != 1 {
+		t.Errorf("got files %v, want the cached one only", files)
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Reset(strings.NewReader("agi_uniqueid: 2\n\n"), &bytes.Buffer{})
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("%s not deleted by Reset", name)
+	}
+}
+
+func TestWriteTempSound(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	tests := []struct {
+		format string
+		err    bool
+	}{
+		{format: "ulaw"},
+		{format: "wav"},
+		{format: "../wav", err: true},
+		{format: "", err: true},
+	}
+	for _, tt := range tests {
+		name, err := writeTempSound([]byte("data"), tt.format)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: no error", tt.format)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(name + "." + tt.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0644 {
+			t.Errorf("%q: got mode %o, want 644", tt.format, mode)
+		}
+	}
+}
+
+// writerFunc is an io.Writer calling the function
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestSayTTS(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	speak := func(ctx context.Context, text string) ([]byte, string, error) {
+		return []byte("audio of " + text), "sln16", nil
+	}
+
+	tests := []struct {
+		name   string
+		synth  func(ctx context.Context, text string) ([]byte, string, error)
+		script string
+		played bool
+		want   string
+		err    bool
+	}{
+		{name: "played", synth: speak, script: "200 result=0 endpos=1000\n", played: true},
+		{name: "escaped", synth: speak, script: "200 result=49 endpos=500\n", played: true, want: "1"},
+		{
+			name: "synth failed",
+			synth: func(ctx context.Context, text string) ([]byte, string, error) {
+				return nil, "", errors.New("quota exceeded")
+			},
+			err: true,
+		},
+		{
+			name: "invalid format",
+			synth: func(ctx context.Context, text string) ([]byte, string, error) {
+				return []byte("audio"), "../sln16", nil
+			},
+			err: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []string
+			var played string
+			w := writerFunc(func(p []byte) (int, error) {
+				line := strings.TrimSuffix(string(p), "\n")
+				sent = append(sent, line)
+				// the file must exist while it is played
+				if f := strings.Fields(line); len(f) > 2 && f[0] == "STREAM" {
+					b, err := os.ReadFile(f[2] + ".sln16")
+					if err != nil {
+						t.Errorf("played file: %v", err)
+					}
+					played = string(b)
+				}
+				return len(p), nil
+			})
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), w)
+
+			digit, err := a.SayTTS(context.Background(), "hello", tt.synth, "12")
+			if (err != nil) != tt.err || digit != tt.want {
+				t.Errorf("got %q, %v; want %q, error %v", digit, err, tt.want, tt.err)
+			}
+			if !tt.played {
+				if len(sent) != 0 {
+					t.Errorf("sent %q, want nothing", sent)
+				}
+				return
+			}
+			if played != "audio of hello" {
+				t.Errorf("played %q, want %q", played, "audio of hello")
+			}
+			// it is removed afterwards
+			name := strings.Fields(sent[0])[2]
+			if _, err := os.Stat(name + ".sln16"); !os.IsNotExist(err) {
+				t.Errorf("file not removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestFileExists(t *testing.T) {
+	tests := []struct {
+		name   string
+		result string
+		sent   string
+		want   bool
+	}{
+		{
+			name:   "custom/welcome.wav",
+			result: "1",
+			sent:   "${STAT(e,${ASTDATADIR}/sounds/custom/welcome.wav)}",
+			want:   true,
+		},
+		{
+			name:   "/tmp/missing.gsm",
+			result: "0",
+			sent:   "${STAT(e,/tmp/missing.gsm)}",
+		},
+		{
+			name:   "/tmp/welcome",
+			result: "0001000000000",
+			sent: "${STAT(e,/tmp/welcome.wav)}${STAT(e,/tmp/welcome.sln)}${STAT(e,/tmp/welcome.sln16)}" +
+				"${STAT(e,/tmp/welcome.ulaw)}${STAT(e,/tmp/welcome.alaw)}${STAT(e,/tmp/welcome.gsm)}" +
+				"${STAT(e,/tmp/welcome.g722)}${STAT(e,/tmp/welcome.g729)}${STAT(e,/tmp/welcome.ogg)}" +
+				"${STAT(e,/tmp/welcome.siren7)}${STAT(e,/tmp/welcome.siren14)}${STAT(e,/tmp/welcome.g726)}" +
+				"${STAT(e,/tmp/welcome.ilbc)}",
+			want: true,
+		},
+		{
+			name:   "/tmp/missing",
+			result: "0000000000000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=1 ("+tt.result+")\n"), &out)
+			got, err := a.FileExists(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if tt.sent != "" && out.String() != "GET FULL VARIABLE \""+tt.sent+"\"\n" {
+				t.Errorf("sent %q", out.String())
+			}
+		})
+	}
+}
+
+func TestFileDuration(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   time.Duration
+		err    bool
+	}{
+		{name: "beep.ulaw", script: "200 result=1 (8000)\n", want: time.Second},
+		{name: "beep.wav", script: "200 result=1 (16044)\n", want: time.Second},
+		{name: "beep.gsm", script: "200 result=1 (3300)\n", want: 2 * time.Second},
+		{name: "beep.mp3", err: true},
+		{name: "beep", script: "200 result=1 (00010000)\n200 result=1 (4000)\n", want: 500 * time.Millisecond},
+		{name: "missing", script: "200 result=1 (00000000)\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+			got, err := a.FileDuration(tt.name)
+			if tt.err {
+				if err == nil {
+					t.Errorf("no error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamFileResumable(t *testing.T) {
+	script := "200 result=49 endpos=8000\n200 result=50 endpos=16000\n200 result=0 endpos=24000\n"
+	var out bytes.Buffer
+	a := New(strings.NewReader("agi_uniqueid: 1\n\n"+script), &out)
+
+	var digits []string
+	digit, resume, err := a.StreamFileResumable("news", "12")
+	for ; err == nil && resume != nil; digit, resume, err = resume() {
+		digits = append(digits, digit)
+	}
+	if err != nil || digit != "" {
+		t.Fatalf("got %q, %v at the end", digit, err)
+	}
+	if got := strings.Join(digits, ","); got != "1,2" {
+		t.Errorf("got digits %s, want 1,2", got)
+	}
+	want := "STREAM FILE news 12 0\nSTREAM FILE news 12 8000\nSTREAM FILE news 12 16000\n"
+	if out.String() != want {
+		t.Errorf("sent %q, want %q", out.String(), want)
+	}
+
+	// without the position reached, playback cannot resume
+	a = New(strings.NewReader("agi_uniqueid: 1\n\n200 result=49\n"), &bytes.Buffer{})
+	if _, resume, err := a.StreamFileResumable("news", "12"); err == nil || resume != nil {
+		t.Errorf("got %v, resume %v; want an error", err, resume != nil)
+	}
+}
+
+func TestStreamFileAt(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		offset time.Duration
+		sent   string
+		err    bool
+	}{
+		{name: "default rate", offset: 1500 * time.Millisecond, sent: "STREAM FILE news \"\" 12000\n"},
+		{name: "wideband", opts: []Option{WithSampleRate(16000)}, offset: 1500 * time.Millisecond, sent: "STREAM FILE news \"\" 24000\n"},
+		{name: "invalid rate", opts: []Option{WithSampleRate(0)}, offset: time.Second, sent: "STREAM FILE news \"\" 8000\n"},
+		{name: "start", offset: 0, sent: "STREAM FILE news \"\" 0\n"},
+		{name: "sub-sample", offset: 100 * time.Microsecond, sent: "STREAM FILE news \"\" 0\n"},
+		{name: "negative", offset: -time.Second, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=0 endpos=48000\n"), &out, tt.opts...)
+			if _, err := a.StreamFileAt("news", "", tt.offset); tt.err != (err != nil) {
+				t.Errorf("got %v", err)
+			}
+			if out.String() != tt.sent {
+				t.Errorf("sent %q, want %q", out.String(), tt.sent)
+			}
+		})
+	}
+}
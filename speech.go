@@ -0,0 +1,58 @@
+package agi
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// GetSpeechOrDTMF plays the prompt while listening both for speech, matched
+// against the given grammar, and for DTMF, and returns whichever comes
+// first: the recognized text, with wasSpeech set, or the digit pressed.  It
+// returns an empty result if the caller said or pressed nothing within the
+// timeout.  The grammar must be known to the speech engine, e.g. loaded from
+// its configuration; the default engine is used.
+func (a *AGI) GetSpeechOrDTMF(prompt string, grammar string, timeout time.Duration) (result string, wasSpeech bool, err error) {
+	if grammar == "" {
+		return "", false, errors.New("no grammar given")
+	}
+
+	resp := a.Command(a.timeouts.Variable, "SPEECH CREATE", `""`)
+	if resp.Error != nil {
+		return "", false, resp.Error
+	}
+	if resp.Result != 1 {
+		return "", false, errors.New("failed to create speech object")
+	}
+	defer a.Command(a.timeouts.Variable, "SPEECH DESTROY") // nolint: errcheck
+
+	resp = a.Command(a.timeouts.Variable, "SPEECH ACTIVATE GRAMMAR", grammar)
+	if resp.Error != nil {
+		return "", false, resp.Error
+	}
+	if resp.Result != 1 {
+		return "", false, errors.New("failed to activate grammar " + grammar)
+	}
+	defer a.Command(a.timeouts.Variable, "SPEECH DEACTIVATE GRAMMAR", grammar) // nolint: errcheck
+
+	if err := a.ensureAnswered(); err != nil {
+		return "", false, err
+	}
+	resp = a.Command(timeout+a.timeouts.StreamFile, "SPEECH RECOGNIZE", prompt, toMSec(timeout))
+	if resp.Error != nil {
+		return "", false, resp.Error
+	}
+
+	fields := resp.Fields()
+	switch resp.flag() {
+	case "speech":
+		return strings.TrimSpace(fields["text0"]), true, nil
+	case "digit":
+		return fields["digit"], false, nil
+	case "hangup":
+		return "", false, ErrHangup
+	case "timeout", "":
+		return "", false, nil
+	}
+	return "", false, errors.New("unexpected speech result: " + resp.flag())
+}
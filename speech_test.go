@@ -0,0 +1,72 @@
+package agi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetSpeechOrDTMF(t *testing.T) {
+	const ok = "200 result=1\n"
+	recognize := []string{
+		`SPEECH CREATE ""`, "SPEECH ACTIVATE GRAMMAR menu", "SPEECH RECOGNIZE main-menu 5000",
+		"SPEECH DEACTIVATE GRAMMAR menu", "SPEECH DESTROY",
+	}
+	tests := []struct {
+		name      string
+		script    string
+		sent      []string
+		result    string
+		wasSpeech bool
+		err       error
+	}{
+		{
+			name:   "speech",
+			script: ok + ok + `200 result=1 (speech) endpos=4000 results=1 score0=870 text0="sales department" grammar0=menu` + "\n" + ok + ok,
+			sent:   recognize, result: "sales department", wasSpeech: true,
+		},
+		{
+			name:   "dtmf",
+			script: ok + ok + "200 result=1 (digit) digit=2 endpos=2000\n" + ok + ok,
+			sent:   recognize, result: "2",
+		},
+		{
+			name:   "timeout",
+			script: ok + ok + "200 result=1 (timeout) endpos=16000\n" + ok + ok,
+			sent:   recognize,
+		},
+		{
+			name:   "hangup",
+			script: ok + ok + "200 result=-1 (hangup)\n" + ok + ok,
+			sent:   recognize, err: ErrHangup,
+		},
+		{
+			name:   "no engine",
+			script: "200 result=0\n",
+			sent:   recognize[:1], err: errors.New("failed to create speech object"),
+		},
+		{
+			name:   "unknown grammar",
+			script: ok + "200 result=0\n" + ok,
+			sent:   []string{`SPEECH CREATE ""`, "SPEECH ACTIVATE GRAMMAR menu", "SPEECH DESTROY"},
+			err:    errors.New("failed to activate grammar menu"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.script), &out)
+
+			result, wasSpeech, err := a.GetSpeechOrDTMF("main-menu", "menu", 5*time.Second)
+			if result != tt.result || wasSpeech != tt.wasSpeech || fmt.Sprint(err) != fmt.Sprint(tt.err) {
+				t.Errorf("got %q, %v, %v; want %q, %v, %v", result, wasSpeech, err, tt.result, tt.wasSpeech, tt.err)
+			}
+			if want := strings.Join(tt.sent, "\n") + "\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
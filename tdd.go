@@ -0,0 +1,42 @@
+package agi
+
+import (
+	"errors"
+	"time"
+)
+
+// TDDMode enables or disables TDD (telecommunications device for the deaf)
+// transmission and reception on the channel.  The mode is one of "on",
+// "off", "tdd" or "mate".
+func (a *AGI) TDDMode(mode string) error {
+	switch mode {
+	case "on", "off", "tdd", "mate":
+	default:
+		return errors.New("invalid TDD mode: " + mode)
+	}
+	resp := a.Command(a.timeouts.Variable, "TDD MODE", mode)
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if resp.Result != 1 {
+		return errors.New("channel is not TDD capable")
+	}
+	return nil
+}
+
+// TDDReceive waits up to the given timeout for text received on the channel,
+// decoded from TDD tones once TDDMode is on.  It returns an empty string if
+// no text was received in time.
+func (a *AGI) TDDReceive(timeout time.Duration) (string, error) {
+	resp := a.Command(timeout+a.timeouts.Variable, "RECEIVE TEXT", toMSec(timeout))
+	if resp.Error != nil {
+		return "", resp.Error
+	}
+	if resp.Result == -1 {
+		if a.isHungup() {
+			return "", ErrHangup
+		}
+		return "", nil
+	}
+	return resp.Value, nil
+}
@@ -0,0 +1,59 @@
+package agi
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTDDMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		response string
+		sent     string
+		err      bool
+	}{
+		{mode: "on", response: "200 result=1", sent: "TDD MODE on\n"},
+		{mode: "mate", response: "200 result=1", sent: "TDD MODE mate\n"},
+		{mode: "on", response: "200 result=0", sent: "TDD MODE on\n", err: true},
+		{mode: "loud", err: true},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &out)
+		if err := a.TDDMode(tt.mode); tt.err != (err != nil) {
+			t.Errorf("%s %q: got %v", tt.mode, tt.response, err)
+		}
+		if out.String() != tt.sent {
+			t.Errorf("%s %q: sent %q, want %q", tt.mode, tt.response, out.String(), tt.sent)
+		}
+	}
+}
+
+func TestTDDReceive(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     string
+		err      error
+	}{
+		{name: "received", response: "200 result=1 (HELLO GA)", want: "HELLO GA"},
+		{name: "timeout", response: "200 result=-1"},
+		{name: "hangup", response: "511 Command Not Permitted on a dead channel or intercept routine", err: ErrHangup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := New(strings.NewReader("agi_uniqueid: 1\n\n"+tt.response+"\n"), &out)
+			got, err := a.TDDReceive(5 * time.Second)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("got %q, %v; want %q, %v", got, err, tt.want, tt.err)
+			}
+			if want := "RECEIVE TEXT 5000\n"; out.String() != want {
+				t.Errorf("sent %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
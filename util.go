@@ -1,8 +1,14 @@
 package agi
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
 func toMSec(dur time.Duration) string {
@@ -16,3 +22,109 @@ func toSec(dur time.Duration) string {
 func toEpoch(when time.Time) string {
 	return strconv.FormatInt(when.Unix(), 10)
 }
+
+var argQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// quoteArg wraps s in double quotes, escaping backslashes and quotes, so that
+// Asterisk parses it as a single command argument.
+func quoteArg(s string) string {
+	return `"` + argQuoter.Replace(s) + `"`
+}
+
+// sanitizeFileName checks a sound file name for STREAM FILE or RECORD FILE,
+// which may come from user data: names with control characters, such as line
+// breaks, or a `..` path element are rejected, and names with spaces, quotes
+// or backslashes are quoted so that they are sent as a single argument.
+func sanitizeFileName(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("empty file name")
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return "", fmt.Errorf("invalid character in file name %q", name)
+		}
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("path traversal in file name %q", name)
+		}
+	}
+	if strings.ContainsAny(name, ` "\`) {
+		return quoteArg(name), nil
+	}
+	return name, nil
+}
+
+// splitFields splits s around runs of white space, keeping double quoted
+// sections (which may contain white space) within a single field.
+func splitFields(s string) []string {
+	var fields []string
+	var field strings.Builder
+	inQuotes, escaped := false, false
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && inQuotes:
+			escaped = true
+		case c == '"':
+			inQuotes = !inQuotes
+		case (c == ' ' || c == '\t') && !inQuotes:
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+			continue
+		}
+		field.WriteRune(c)
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// unquote removes the double quotes wrapping s, if any, along with the
+// backslashes escaping quotes and backslashes within it.
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	escaped := false
+	for _, c := range s {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// validateDTMFSet checks that s only contains DTMF digits (0-9, *, #, A-D).
+// The empty set is valid.
+func validateDTMFSet(s string) error {
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9', c == '*', c == '#':
+		case c >= 'A' && c <= 'D', c >= 'a' && c <= 'd':
+		default:
+			return fmt.Errorf("%w %q in %q", ErrInvalidDTMF, c, s)
+		}
+	}
+	return nil
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
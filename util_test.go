@@ -0,0 +1,95 @@
+package agi
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateDTMFSet(t *testing.T) {
+	tests := []struct {
+		set   string
+		valid bool
+	}{
+		{"", true},
+		{"0123456789*#", true},
+		{"ABCDabcd", true},
+		{"12 3", false},
+		{"1e", false},
+		{`"`, false},
+	}
+	for _, tt := range tests {
+		err := validateDTMFSet(tt.set)
+		if tt.valid != (err == nil) {
+			t.Errorf("%q: got %v", tt.set, err)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidDTMF) {
+			t.Errorf("%q: got %v, want ErrInvalidDTMF", tt.set, err)
+		}
+	}
+}
+
+func TestInvalidEscapeDigits(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(a *AGI) error
+	}{
+		{"StreamFile", func(a *AGI) error { _, err := a.StreamFile("hello", "1 2", 0); return err }},
+		{"SayDigits", func(a *AGI) error { _, err := a.SayDigits("12", "x"); return err }},
+		{"SayAlpha", func(a *AGI) error { _, err := a.SayAlpha("ab", "\"#"); return err }},
+		{"Record", func(a *AGI) error { return a.Record("msg", &RecordOptions{EscapeDigits: "#!"}) }},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=0\n"), &out)
+		if err := tt.run(a); !errors.Is(err, ErrInvalidDTMF) {
+			t.Errorf("%s: got %v, want ErrInvalidDTMF", tt.name, err)
+		}
+		if out.Len() != 0 {
+			t.Errorf("%s: sent %q", tt.name, out.String())
+		}
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  bool
+	}{
+		{name: "custom/welcome", want: "custom/welcome"},
+		{name: "/var/spool/asterisk/voicemail/100/INBOX/msg0000", want: "/var/spool/asterisk/voicemail/100/INBOX/msg0000"},
+		{name: "prompts/John Doe", want: `"prompts/John Doe"`},
+		{name: `prompts/say "hi"`, want: `"prompts/say \"hi\""`},
+		{name: `prompts\x`, want: `"prompts\\x"`},
+		{name: "..welcome", want: "..welcome"},
+		{name: "../../etc/passwd", err: true},
+		{name: "custom/../../secret", err: true},
+		{name: "custom/..", err: true},
+		{name: "welcome\nHANGUP", err: true},
+		{name: "", err: true},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeFileName(tt.name)
+		if got != tt.want || tt.err != (err != nil) {
+			t.Errorf("%q: got %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	// StreamFile and Record send the sanitized name, or nothing
+	var out bytes.Buffer
+	a := New(strings.NewReader("agi_uniqueid: 1\n\n200 result=0 endpos=0\n"), &out)
+	if _, err := a.StreamFile("prompts/John Doe", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.StreamFile("../secret", "", 0); err == nil {
+		t.Error("StreamFile: no error for a path traversal")
+	}
+	if err := a.Record("../../tmp/msg", nil); err == nil {
+		t.Error("Record: no error for a path traversal")
+	}
+	if want := `STREAM FILE "prompts/John Doe" "" 0` + "\n"; out.String() != want {
+		t.Errorf("sent %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,169 @@
+package agi
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is a parsed Asterisk version number
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// Regex for the numeric part of an Asterisk version string, such as
+// "13.18.3", "certified/18.9-cert1" or "1.8.32.3"
+var versionRegex = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// ParseVersion extracts the major, minor and patch numbers from an Asterisk
+// version string.  Development builds without a version number (e.g.
+// "GIT-master-1234abc") cannot be parsed and return an error.
+func ParseVersion(s string) (Version, error) {
+	pieces := versionRegex.FindStringSubmatch(s)
+	if pieces == nil {
+		return Version{}, fmt.Errorf("failed to parse version %q", s)
+	}
+
+	var v Version
+	v.Major, _ = strconv.Atoi(pieces[1])
+	v.Minor, _ = strconv.Atoi(pieces[2])
+	if pieces[3] != "" {
+		v.Patch, _ = strconv.Atoi(pieces[3])
+	}
+	return v, nil
+}
+
+// Compare returns -1, 0 or 1 when v is respectively older than, equal to or
+// newer than o.
+func (v Version) Compare(o Version) int {
+	for _, d := range [...]int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// AtLeast reports whether v is the given version or a newer one.
+func (v Version) AtLeast(major, minor int) bool {
+	return v.Compare(Version{Major: major, Minor: minor}) >= 0
+}
+
+// String returns the version as "major.minor.patch"
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// AsteriskVersion returns the Asterisk version string sent in `agi_version`.
+func (a *AGI) AsteriskVersion() string {
+	v, _ := a.Variable("agi_version")
+	return v
+}
+
+// Version returns the parsed Asterisk version of the session.
+func (a *AGI) Version() (Version, error) {
+	return ParseVersion(a.AsteriskVersion())
+}
+
+// SupportsSpeech reports whether the Asterisk version is recent enough to
+// provide the SPEECH family of AGI commands (Asterisk 1.6 and later).  It
+// only looks at the version: res_speech and an engine must still be loaded.
+// Unparseable versions are assumed to be development builds and supported.
+func (a *AGI) SupportsSpeech() bool {
+	v, err := a.Version()
+	if err != nil {
+		return a.AsteriskVersion() != ""
+	}
+	return v.AtLeast(1, 6)
+}
+
+// dialect holds the syntax differences between Asterisk versions that the
+// commands of the package must adapt to.  The argument order of SAY
+// DATETIME has not changed across releases, so it is not part of it.
+type dialect struct {
+	// appSep separates the arguments of dialplan applications run with EXEC
+	appSep string
+
+	// parkArgs returns the arguments of the Park application for a timeout
+	parkArgs func(timeout time.Duration) (string, error)
+}
+
+// sayDateTimeArgs lays out the arguments of SAY DATETIME after the verb:
+// time, escape digits, then the format and the optional time zone
+func sayDateTimeArgs(when, escapeDigits, format, zone string) []string {
+	args := []string{when, escapeDigits, format}
+	if zone != "" {
+		args = append(args, zone)
+	}
+	return args
+}
+
+var (
+	// legacyDialect is the dialect of Asterisk before 1.6, which predates
+	// `agi_version` and separates application arguments with `|`
+	legacyDialect = dialect{
+		appSep: "|",
+		parkArgs: func(timeout time.Duration) (string, error) {
+			if timeout > 0 {
+				return "", errors.New("Park timeout not supported before Asterisk 1.6")
+			}
+			return "", nil
+		},
+	}
+
+	// featuresDialect is the dialect of Asterisk 1.6 to 11, whose Park
+	// application, in features.c, takes the timeout in milliseconds first
+	featuresDialect = dialect{
+		appSep: ",",
+		parkArgs: func(timeout time.Duration) (string, error) {
+			if timeout > 0 {
+				return strconv.Itoa(int(timeout / time.Millisecond)), nil
+			}
+			return "", nil
+		},
+	}
+
+	// modernDialect is the dialect of Asterisk 12 and later, whose Park
+	// application, in res_parking, takes the parking lot then options
+	modernDialect = dialect{
+		appSep: ",",
+		parkArgs: func(timeout time.Duration) (string, error) {
+			if timeout > 0 {
+				return ",t(" + strconv.Itoa(int(timeout.Seconds())) + ")", nil
+			}
+			return "", nil
+		},
+	}
+)
+
+// dialect returns the dialect of the Asterisk version of the session.  As
+// for SupportsSpeech, a missing version means a release before 1.6, and an
+// unparseable one a recent development build.
+func (a *AGI) dialect() dialect {
+	v, err := a.Version()
+	switch {
+	case err != nil && a.AsteriskVersion() == "":
+		return legacyDialect
+	case err != nil:
+		return modernDialect
+	case !v.AtLeast(1, 6):
+		return legacyDialect
+	case !v.AtLeast(12, 0):
+		return featuresDialect
+	}
+	return modernDialect
+}
+
+// appArgs joins the arguments of a dialplan application run with EXEC using
+// the separator of the Asterisk version: `|` before 1.6, `,` since.
+func (a *AGI) appArgs(args ...string) string {
+	return strings.Join(args, a.dialect().appSep)
+}
@@ -0,0 +1,125 @@
+package agi
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    Version
+		err     bool
+	}{
+		{version: "13.18.3", want: Version{13, 18, 3}},
+		{version: "1.8.32.3", want: Version{1, 8, 32}},
+		{version: "certified/18.9-cert1", want: Version{18, 9, 0}},
+		{version: "20.5", want: Version{20, 5, 0}},
+		{version: "GIT-master-1234abc", err: true},
+		{version: "", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseVersion(tt.version)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("%q: got %v, %v; want %v", tt.version, got, err, tt.want)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	tests := []struct {
+		v, o Version
+		want int
+	}{
+		{Version{13, 18, 3}, Version{13, 18, 3}, 0},
+		{Version{13, 18, 3}, Version{13, 18, 4}, -1},
+		{Version{13, 19, 0}, Version{13, 18, 9}, 1},
+		{Version{1, 6, 0}, Version{12, 0, 0}, -1},
+	}
+	for _, tt := range tests {
+		if got := tt.v.Compare(tt.o); got != tt.want {
+			t.Errorf("%v.Compare(%v) = %d, want %d", tt.v, tt.o, got, tt.want)
+		}
+	}
+}
+
+func TestSupportsSpeech(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"", false},
+		{"1.4.21", false},
+		{"1.6.0", true},
+		{"18.20.0", true},
+		{"GIT-master-1234abc", true},
+	}
+	for _, tt := range tests {
+		a := New(strings.NewReader("agi_version: "+tt.version+"\n\n"), &bytes.Buffer{})
+		if got := a.SupportsSpeech(); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.version, got, tt.want)
+		}
+		if got := a.AsteriskVersion(); got != tt.version {
+			t.Errorf("AsteriskVersion: got %q, want %q", got, tt.version)
+		}
+	}
+}
+
+func TestDialect(t *testing.T) {
+	tests := []struct {
+		version string
+		park    string
+		parkErr bool
+	}{
+		{version: "", parkErr: true},
+		{version: "1.4.21", parkErr: true},
+		{version: "1.8.32.3", park: "EXEC Park \"30000\"\n"},
+		{version: "11.25.3", park: "EXEC Park \"30000\"\n"},
+		{version: "18.20.0", park: "EXEC Park \",t(30)\"\n"},
+		{version: "GIT-master-abc123", park: "EXEC Park \",t(30)\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			script := "agi_version: " + tt.version + "\n\n200 result=0\n200 result=1 (701)\n"
+			var out bytes.Buffer
+			a := New(strings.NewReader(script), &out)
+
+			err := a.Park(30 * time.Second)
+			if tt.parkErr {
+				if err == nil {
+					t.Errorf("Park: no error for a timeout")
+				}
+				if out.Len() != 0 {
+					t.Errorf("Park: sent %q", out.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _, _ := strings.Cut(out.String(), "GET"); got != tt.park {
+				t.Errorf("Park: got %q, want %q", got, tt.park)
+			}
+		})
+	}
+}
+
+func TestAppArgs(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{"", "a|b"},
+		{"1.4.21", "a|b"},
+		{"1.6.2.0", "a,b"},
+		{"20.5.0", "a,b"},
+	}
+	for _, tt := range tests {
+		a := New(strings.NewReader("agi_version: "+tt.version+"\n\n"), &bytes.Buffer{})
+		if got := a.appArgs("a", "b"); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.version, got, tt.want)
+		}
+	}
+}